@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// openMetricsEscaper escapes label values per the OpenMetrics text format
+var openMetricsEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// backfill run a single collection and write the timestamped gauges from it to
+// path as OpenMetrics.  Pushgateway won't accept samples with timestamps, so
+// the output is meant for promtool's backfilling instead.
+func backfill(instances []sentryInstance, path string) (err error) {
+	registry := prometheus.NewRegistry()
+	if err := registerInstances(registry, instances); err != nil {
+		return err
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	samples := 0
+	for _, family := range families {
+		typed := false
+		for _, metric := range family.Metric {
+			// only the per bucket stats carry timestamps; everything else is
+			// about this run of the exporter, not the backfilled day.
+			if metric.TimestampMs == nil || metric.Gauge == nil {
+				continue
+			}
+			value := metric.Gauge.GetValue()
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			if !typed {
+				fmt.Fprintf(w, "# TYPE %s gauge\n", family.GetName())
+				typed = true
+			}
+			labels := make([]string, 0, len(metric.Label))
+			for _, label := range metric.Label {
+				labels = append(labels, fmt.Sprintf(`%s="%s"`, label.GetName(), openMetricsEscaper.Replace(label.GetValue())))
+			}
+			fmt.Fprintf(w, "%s{%s} %s %d\n", family.GetName(), strings.Join(labels, ","), strconv.FormatFloat(value, 'g', -1, 64), metric.GetTimestampMs()/1000)
+			samples++
+		}
+	}
+	fmt.Fprint(w, "# EOF\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	log.Infof("backfill wrote %d samples", samples)
+	return nil
+}
@@ -0,0 +1,64 @@
+// Package config parses the exporter's list valued flags, so malformed values are
+// rejected at startup instead of misbehaving mid scrape.
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ParseList split a comma separated list, trimming whitespace around entries.
+// An empty value is an empty list; empty entries, including trailing commas,
+// are an error.
+func ParseList(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	entries := strings.Split(value, ",")
+	for i := range entries {
+		entries[i] = strings.TrimSpace(entries[i])
+		if entries[i] == "" {
+			return nil, fmt.Errorf("entry %d of %q is empty", i+1, value)
+		}
+	}
+	return entries, nil
+}
+
+// ParseChoices parse a comma separated list where each entry must be one of
+// allowed, and may only be given once
+func ParseChoices(value string, allowed []string) ([]string, error) {
+	entries, err := ParseList(value)
+	if err != nil {
+		return nil, err
+	}
+	valid := make(map[string]bool, len(allowed))
+	for _, choice := range allowed {
+		valid[choice] = true
+	}
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if !valid[entry] {
+			return nil, fmt.Errorf("unknown entry %q; must be one of %s", entry, strings.Join(allowed, ", "))
+		}
+		if seen[entry] {
+			return nil, fmt.Errorf("entry %q is given more than once", entry)
+		}
+		seen[entry] = true
+	}
+	return entries, nil
+}
+
+// ParseGlobs parse a comma separated list of path.Match patterns
+func ParseGlobs(value string) ([]string, error) {
+	entries, err := ParseList(value)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if _, err := path.Match(entry, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", entry, err)
+		}
+	}
+	return entries, nil
+}
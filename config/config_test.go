@@ -0,0 +1,117 @@
+package config
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+// malformedLists seeds the fuzzers with empty values, stray commas, whitespace,
+// and bad glob patterns.
+var malformedLists = []string{
+	"",
+	" ",
+	",",
+	",,",
+	"a,",
+	",a",
+	"a,,b",
+	" a , b ",
+	"a, ,b",
+	"received,received",
+	"received,rejected",
+	"unknown",
+	"web-*",
+	"[",
+	"web-[",
+	"a,[]",
+	"\\",
+	"web-\\",
+	"[a-",
+	"a\x00b",
+	"\xff",
+}
+
+func FuzzParseList(f *testing.F) {
+	for _, seed := range malformedLists {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		entries, err := ParseList(value)
+		if err != nil {
+			return
+		}
+		if strings.TrimSpace(value) == "" {
+			if len(entries) != 0 {
+				t.Fatalf("ParseList(%q) = %q, want no entries for a blank value", value, entries)
+			}
+			return
+		}
+		if want := strings.Count(value, ",") + 1; len(entries) != want {
+			t.Fatalf("ParseList(%q) returned %d entries, want %d", value, len(entries), want)
+		}
+		for _, entry := range entries {
+			if entry == "" || entry != strings.TrimSpace(entry) || strings.Contains(entry, ",") {
+				t.Fatalf("ParseList(%q) returned malformed entry %q", value, entry)
+			}
+		}
+	})
+}
+
+func FuzzParseChoices(f *testing.F) {
+	allowed := []string{"received", "rejected", "blacklisted"}
+	for _, seed := range malformedLists {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		entries, err := ParseChoices(value, allowed)
+		if err != nil {
+			return
+		}
+		seen := make(map[string]bool, len(entries))
+		for _, entry := range entries {
+			if entry != "received" && entry != "rejected" && entry != "blacklisted" {
+				t.Fatalf("ParseChoices(%q) returned %q, which isn't allowed", value, entry)
+			}
+			if seen[entry] {
+				t.Fatalf("ParseChoices(%q) returned %q more than once", value, entry)
+			}
+			seen[entry] = true
+		}
+	})
+}
+
+func FuzzParseGlobs(f *testing.F) {
+	for _, seed := range malformedLists {
+		f.Add(seed, "web-api")
+	}
+	f.Fuzz(func(t *testing.T, value, slug string) {
+		patterns, err := ParseGlobs(value)
+		if err != nil {
+			return
+		}
+		// accepted patterns are matched without checking the error during
+		// scrapes, so they must be valid against any slug.
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, slug); err != nil {
+				t.Fatalf("ParseGlobs(%q) accepted %q, which fails matching %q: %s", value, pattern, slug, err)
+			}
+		}
+	})
+}
+
+func TestParseListErrors(t *testing.T) {
+	for _, value := range []string{",", "a,", ",a", "a,,b", "a, ,b"} {
+		if _, err := ParseList(value); err == nil {
+			t.Errorf("ParseList(%q) succeeded, want an error for the empty entry", value)
+		}
+	}
+}
+
+func TestParseGlobsErrors(t *testing.T) {
+	for _, value := range []string{"[", "web-[", "a,[]", "web-\\"} {
+		if _, err := ParseGlobs(value); err == nil {
+			t.Errorf("ParseGlobs(%q) succeeded, want an error for the bad pattern", value)
+		}
+	}
+}
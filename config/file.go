@@ -0,0 +1,117 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// File is the layout of the YAML config file.  Every key is optional, and each
+// one stands for the flag noted beside it.
+type File struct {
+	Instances            []Instance    `yaml:"instances"`             // -sentry.url, -sentry.auth-token
+	Organizations        []string      `yaml:"organizations"`         // -sentry.organizations
+	ExcludeOrganizations []string      `yaml:"exclude_organizations"` // -sentry.exclude-organizations
+	Projects             []string      `yaml:"projects"`              // -sentry.projects
+	ExcludeProjects      []string      `yaml:"exclude_projects"`      // -sentry.exclude-projects
+	StatTypes            []string      `yaml:"stat_types"`            // -sentry.stat-types
+	StatResolution       string        `yaml:"stat_resolution"`       // -sentry.stat-resolution
+	StatWindow           time.Duration `yaml:"stat_window"`           // -sentry.stat-window
+	Concurrency          int           `yaml:"concurrency"`           // -sentry.fetch-concurrency
+	OrgConcurrency       int           `yaml:"org_concurrency"`       // -sentry.org-concurrency
+	StatConcurrency      int           `yaml:"stat_concurrency"`      // -sentry.stat-concurrency
+}
+
+// Instance is a sentry to export.  AuthToken may be left out of every instance
+// to take the token from -sentry.auth-token or its environment variable instead.
+type Instance struct {
+	URL       string `yaml:"url"`
+	AuthToken string `yaml:"auth_token"`
+}
+
+// Setting is a flag value given by the config file, along with the key it came
+// from for error messages
+type Setting struct {
+	Key, Flag, Value string
+}
+
+// LoadFile parse the YAML config file at path; see Parse.
+func LoadFile(path string) (*File, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(content)
+}
+
+// Parse parse a YAML config.  Unknown keys and values of the wrong type are
+// errors, reported with their line.
+func Parse(content []byte) (*File, error) {
+	var file File
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// Settings returns the flag values the file gives, one per value for flags that
+// may be repeated.  Values themselves are checked when the flags are parsed.
+func (f *File) Settings() ([]Setting, error) {
+	var settings []Setting
+	tokens := 0
+	for i, instance := range f.Instances {
+		key := fmt.Sprintf("instances[%d]", i)
+		if instance.URL == "" {
+			return nil, fmt.Errorf("%s.url is required", key)
+		}
+		settings = append(settings, Setting{key + ".url", "sentry.url", instance.URL})
+		if instance.AuthToken != "" {
+			tokens++
+			settings = append(settings, Setting{key + ".auth_token", "sentry.auth-token", instance.AuthToken})
+		}
+	}
+	if tokens != 0 && tokens != len(f.Instances) {
+		return nil, fmt.Errorf("instances: auth_token must be given for every instance or none of them")
+	}
+	for _, list := range []struct {
+		key, flag string
+		entries   []string
+	}{
+		{"organizations", "sentry.organizations", f.Organizations},
+		{"exclude_organizations", "sentry.exclude-organizations", f.ExcludeOrganizations},
+		{"projects", "sentry.projects", f.Projects},
+		{"exclude_projects", "sentry.exclude-projects", f.ExcludeProjects},
+		{"stat_types", "sentry.stat-types", f.StatTypes},
+	} {
+		if len(list.entries) == 0 {
+			continue
+		}
+		for i, entry := range list.entries {
+			// the flags are comma separated lists.
+			if strings.TrimSpace(entry) == "" || strings.Contains(entry, ",") {
+				return nil, fmt.Errorf("%s[%d] must be non empty and may not contain commas, got %q", list.key, i, entry)
+			}
+		}
+		settings = append(settings, Setting{list.key, list.flag, strings.Join(list.entries, ",")})
+	}
+	if f.StatResolution != "" {
+		settings = append(settings, Setting{"stat_resolution", "sentry.stat-resolution", f.StatResolution})
+	}
+	if f.StatWindow != 0 {
+		settings = append(settings, Setting{"stat_window", "sentry.stat-window", f.StatWindow.String()})
+	}
+	if f.Concurrency != 0 {
+		settings = append(settings, Setting{"concurrency", "sentry.fetch-concurrency", strconv.Itoa(f.Concurrency)})
+	}
+	if f.OrgConcurrency != 0 {
+		settings = append(settings, Setting{"org_concurrency", "sentry.org-concurrency", strconv.Itoa(f.OrgConcurrency)})
+	}
+	if f.StatConcurrency != 0 {
+		settings = append(settings, Setting{"stat_concurrency", "sentry.stat-concurrency", strconv.Itoa(f.StatConcurrency)})
+	}
+	return settings, nil
+}
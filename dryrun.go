@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dryRun print the organization/team/project slugs each instance would
+// collect, one per line, prefixed with the instance url when there are several.
+func dryRun(instances []sentryInstance) error {
+	w := bufio.NewWriter(os.Stdout)
+	var failed error
+	for _, instance := range instances {
+		projects, err := instance.exporter.Discover(context.Background())
+		for _, project := range projects {
+			if len(instances) > 1 {
+				fmt.Fprintf(w, "%s ", instance.url)
+			}
+			fmt.Fprintf(w, "%s/%s/%s\n", project.Organization, project.Team, project.Project)
+		}
+		log.Infof("discovered %d projects for %s", len(projects), instance.url)
+		if err != nil {
+			log.Errorf("discovery against %s was incomplete: %s", instance.url, err)
+			failed = err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return failed
+}
@@ -0,0 +1,119 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/atlassian/go-sentry-api"
+)
+
+// go-sentry-api doesn't cover every endpoint the exporter needs.  GetPage will
+// fetch any path relative to the client endpoint, so it's used as the request
+// path for those endpoints; auth and error handling still come from the client.
+// Listings are walked via the exporter's pager.
+
+// maxPageSize is the largest per_page sentry allows
+const maxPageSize = 100
+
+// pagedPath returns path with the configured page size requested, if any.  Sentry
+// carries per_page over into the pagination links, so it's only needed for the
+// first page.
+func (e *Exporter) pagedPath(path string) string {
+	if e.pageSize == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s?per_page=%d", path, e.pageSize)
+}
+
+// listedProject is a project from an organization's project listing, with the
+// configured platform go-sentry-api doesn't decode; it's nil if there's none.
+type listedProject struct {
+	sentry.Project
+	Platform *string `json:"platform"`
+}
+
+// getOrganizationProjects fetch every project in the organization, including
+// projects that aren't assigned to any team.
+func (e *Exporter) getOrganizationProjects(ctx context.Context, organization *sentry.Organization) ([]listedProject, error) {
+	var projects []listedProject
+	path := e.pagedPath(fmt.Sprintf("organizations/%s/projects/", *organization.Slug))
+	for path != "" {
+		var batch []listedProject
+		start := time.Now()
+		next, err := e.pager.fetchPage(ctx, path, &batch)
+		e.observeRequest("get_page", start)
+		if e.countAPIError("get_page", err) != nil {
+			return nil, err
+		}
+		projects = append(projects, batch...)
+		path = next
+	}
+	return projects, nil
+}
+
+// getProjectStats fetch the project's stats for the given window.  This isn't
+// GetProjectStats since that never sends the resolution, leaving sentry to pick
+// the bucket size.
+func (e *Exporter) getProjectStats(ctx context.Context, organization *sentry.Organization, project *sentry.Project, stat sentry.StatQuery, since, until time.Time) ([]sentry.Stat, error) {
+	query := url.Values{}
+	query.Add("stat", string(stat))
+	query.Add("since", strconv.FormatInt(since.Unix(), 10))
+	query.Add("until", strconv.FormatInt(until.Unix(), 10))
+	query.Add("resolution", e.statResolution)
+	var stats []sentry.Stat
+	page := sentry.Page{URL: fmt.Sprintf("projects/%s/%s/stats/?%s", *organization.Slug, *project.Slug, query.Encode())}
+	err := e.withRetries(ctx, "stats for project "+*project.Slug, func() error {
+		client, cancel := e.clientWithTimeout(ctx, e.statsTimeout)
+		defer cancel()
+		start := time.Now()
+		_, err := client.GetPage(page, &stats)
+		e.observeRequest("get_project_stats", start)
+		return err
+	})
+	return stats, e.countAPIError("get_project_stats", err)
+}
+
+// apiOperations are the operation label values of the API error counter
+var apiOperations = []string{"get_organizations", "get_organization", "get_project_stats", "get_client_keys", "get_page"}
+
+// countListing returns the number of entries in the listing at path, walking
+// every page of it since sentry gives no totals.
+func (e *Exporter) countListing(ctx context.Context, path string) (int, error) {
+	count := 0
+	for path != "" {
+		// only the number of entries matters
+		var entries []struct{}
+		start := time.Now()
+		next, err := e.pager.fetchPage(ctx, path, &entries)
+		e.observeRequest("get_page", start)
+		if e.countAPIError("get_page", err) != nil {
+			return 0, err
+		}
+		count += len(entries)
+		path = next
+	}
+	return count, nil
+}
+
+// observeRequest record the duration of an API request for the operation that
+// started at start
+func (e *Exporter) observeRequest(operation string, start time.Time) {
+	e.requestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// countAPIError count err against the operation if it's set, returning it as is
+func (e *Exporter) countAPIError(operation string, err error) error {
+	if err != nil {
+		e.apiErrors.WithLabelValues(operation).Inc()
+	}
+	return err
+}
+
+// isAuthError returns if err is sentry rejecting the auth token
+func isAuthError(err error) bool {
+	apiErr, ok := err.(sentry.APIError)
+	return ok && (apiErr.StatusCode == 401 || apiErr.StatusCode == 403)
+}
@@ -0,0 +1,38 @@
+package exporter
+
+import (
+	"sync"
+	"time"
+)
+
+// ttlCache is a concurrency safe string cache whose entries expire after ttl
+type ttlCache struct {
+	ttl     time.Duration
+	lock    sync.Mutex
+	entries map[string]cachedValue
+}
+
+type cachedValue struct {
+	value   string
+	expires time.Time
+}
+
+func newTTLCache(ttl time.Duration) *ttlCache {
+	return &ttlCache{ttl: ttl, entries: make(map[string]cachedValue)}
+}
+
+func (c *ttlCache) get(key string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.value, true
+}
+
+func (c *ttlCache) set(key, value string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[key] = cachedValue{value: value, expires: time.Now().Add(c.ttl)}
+}
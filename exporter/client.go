@@ -0,0 +1,87 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/go-sentry-api"
+	"golang.org/x/time/rate"
+)
+
+// SentryClient the parts of the go-sentry-api client the exporter uses, so
+// collection can run against something other than a live sentry.
+// *sentry.Client satisfies it.
+type SentryClient interface {
+	GetOrganization(orgslug string) (sentry.Organization, error)
+	GetPage(p sentry.Page, out interface{}) (*sentry.Link, error)
+}
+
+// contextTransport binds every request sent through it to ctx.  go-sentry-api
+// builds its requests without a context, so this is how calls get deadlines.
+// Requests wait out any throttle pause, and then the limiter if there is one.
+// Once budget requests have been counted in requests, further ones fail without
+// being sent and exceeded is set.
+type contextTransport struct {
+	ctx      context.Context
+	base     http.RoundTripper
+	throttle *throttle
+	limiter  *rate.Limiter
+	requests *int64
+	budget   int64
+	exceeded *int32
+}
+
+// errRequestBudgetExceeded is returned for requests past the per scrape budget
+var errRequestBudgetExceeded = errors.New("per scrape request budget exceeded")
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.throttle.wait(t.ctx); err != nil {
+		return nil, err
+	}
+	if t.limiter != nil {
+		if err := t.limiter.Wait(t.ctx); err != nil {
+			return nil, err
+		}
+	}
+	if requests := atomic.AddInt64(t.requests, 1); t.budget > 0 && requests > t.budget {
+		atomic.AddInt64(t.requests, -1)
+		atomic.StoreInt32(t.exceeded, 1)
+		return nil, errRequestBudgetExceeded
+	}
+	resp, err := t.base.RoundTrip(req.WithContext(t.ctx))
+	if err == nil {
+		t.throttle.observe(resp)
+	}
+	return resp, err
+}
+
+// clientWithTimeout returns a copy of the sentry client whose requests are
+// abandoned once timeout passes or ctx is done; a timeout of 0 means only ctx
+// applies.  Call cancel once done with the client.  Clients other than
+// *sentry.Client have no transport to bind, so they're returned as is; the
+// timeout, rate limits, and request budget only apply to *sentry.Client.
+func (e *Exporter) clientWithTimeout(ctx context.Context, timeout time.Duration) (client SentryClient, cancel context.CancelFunc) {
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	sentryClient, ok := e.client.(*sentry.Client)
+	if !ok {
+		return e.client, cancel
+	}
+	base := sentryClient.HTTPClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	httpClient := *sentryClient.HTTPClient
+	httpClient.Transport = &contextTransport{ctx: ctx, base: base, throttle: e.throttle, limiter: e.limiter, requests: &e.requests, budget: e.requestBudget, exceeded: &e.budgetExceeded}
+	// the context enforces the timeout instead.
+	httpClient.Timeout = 0
+	clientCopy := *sentryClient
+	clientCopy.HTTPClient = &httpClient
+	return &clientCopy, cancel
+}
@@ -0,0 +1,64 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/atlassian/go-sentry-api"
+	log "github.com/sirupsen/logrus"
+)
+
+// DiscoveredProject a project collection would cover, by slug.  Team follows
+// -sentry.teamless-projects for projects no team lists.
+type DiscoveredProject struct {
+	Organization string
+	Team         string
+	Project      string
+}
+
+// Discover enumerate the organizations, teams, and projects a collection would
+// cover once filters and sharding are applied, without fetching any stats.
+// Organizations that fail to enumerate are skipped and reported in the error.
+func (e *Exporter) Discover(ctx context.Context) ([]DiscoveredProject, error) {
+	var discovered []DiscoveredProject
+	enqueue := func(job *projectFetchJob) {
+		if !e.projectWanted(*job.project.Slug) || !e.inShard(job.project.ID) {
+			return
+		}
+		labels := e.projectLabels(job)
+		discovered = append(discovered, DiscoveredProject{Organization: labels[0], Team: labels[2], Project: labels[4]})
+	}
+	var failed int
+	for page := e.pagedPath("organizations/"); page != ""; {
+		var organizations []sentry.Organization
+		var next string
+		err := e.withRetries(ctx, "organization listing", func() (err error) {
+			start := time.Now()
+			next, err = e.pager.fetchPage(ctx, page, &organizations)
+			e.observeRequest("get_organizations", start)
+			return err
+		})
+		if e.countAPIError("get_organizations", err) != nil {
+			return discovered, fmt.Errorf("failed listing organizations: %s", err)
+		}
+		for _, organization := range organizations {
+			if e.anomalous("organization.slug", organization.Slug == nil, "organization "+organization.Name) {
+				failed++
+				continue
+			}
+			if !e.organizationWanted(*organization.Slug) {
+				log.Debugf("skipping filtered organization %s", *organization.Slug)
+				continue
+			}
+			if _, err := e.enumerateOrganization(ctx, *organization.Slug, enqueue); err != nil {
+				failed++
+			}
+		}
+		page = next
+	}
+	if failed != 0 {
+		return discovered, fmt.Errorf("%d organizations couldn't be enumerated", failed)
+	}
+	return discovered, nil
+}
@@ -1,73 +1,639 @@
 package exporter
 
 import (
+	"context"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"path"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/atlassian/go-sentry-api"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 )
 
 var collectedProjectStats = map[string]sentry.StatQuery{
 	"received":    sentry.StatReceived,
 	"rejected":    sentry.StatRejected,
 	"blacklisted": sentry.StatBlacklisted,
+	"forwarded":   statForwarded,
+}
+
+// statForwarded counts events sent on by data forwarding; go-sentry-api has no
+// constant for it.
+const statForwarded sentry.StatQuery = "forwarded"
+
+// optInStatTypes are collected only when asked for, rather than by default;
+// most installs don't forward data, so they'd be a request per project for
+// nothing.
+var optInStatTypes = map[string]bool{"forwarded": true}
+
+// storedStatType is the stat type for events sentry stored, fetched alongside
+// collectedProjectStats if stored stats are enabled; it's reported as received
+// events in the stored dimension.
+const storedStatType = "stored"
+
+// statTypeName restricts stat type names to what's usable in a metric name
+var statTypeName = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// RegisterStatType add a project stat type for exporters to collect, fetched
+// from sentry as query.  It must be called before NewExporter; exporters that
+// already exist don't see it, and registering concurrently with a running
+// exporter isn't safe.  Names must be unique.
+func RegisterStatType(name string, query sentry.StatQuery) error {
+	if !statTypeName.MatchString(name) {
+		return fmt.Errorf("stat type %q isn't a valid metric name component", name)
+	}
+	if _, ok := collectedProjectStats[name]; ok || name == storedStatType {
+		return fmt.Errorf("stat type %q is already registered", name)
+	}
+	collectedProjectStats[name] = query
+	return nil
+}
+
+// registeredStatTypes returns a copy of collectedProjectStats, minus the opt in
+// stat types
+func registeredStatTypes() map[string]sentry.StatQuery {
+	stats := make(map[string]sentry.StatQuery, len(collectedProjectStats))
+	for statType, query := range collectedProjectStats {
+		if !optInStatTypes[statType] {
+			stats[statType] = query
+		}
+	}
+	return stats
+}
+
+// DefaultStatTypes returns the project stat types collected unless
+// WithStatTypes says otherwise
+func DefaultStatTypes() []string {
+	var types []string
+	for statType := range registeredStatTypes() {
+		types = append(types, statType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// StatTypes returns the project stat types the exporter can collect
+func StatTypes() []string {
+	var types []string
+	for statType := range collectedProjectStats {
+		types = append(types, statType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// statResolutions maps the stat resolutions sentry accepts to their bucket size
+var statResolutions = map[string]time.Duration{
+	"10s": time.Second * 10,
+	"1h":  time.Hour,
+	"1d":  time.Hour * 24,
 }
 
 // Exporter exporter for sentry metrics
 type Exporter struct {
-	client                 *sentry.Client
+	client                 SentryClient
 	maxFetchConccurrency   uint32
+	maxOrgConcurrency      uint32
 	projectStatDesc        *prometheus.Desc
+	rejectionRatioDesc     *prometheus.Desc
+	savedQueryDesc         *prometheus.Desc
 	statResolution         string
 	statResolutionDuration time.Duration
 	sentryUp               *prometheus.Desc
 	scrapeDurationDesc     *prometheus.Desc
+	workerIdleDesc         *prometheus.Desc
+	workerBusyDesc         *prometheus.Desc
+	saturationDesc         *prometheus.Desc
+	// nil unless stat fetches are capped along with other exporters
+	sharedConcurrency        *SharedConcurrency
+	effectiveConcurrencyDesc *prometheus.Desc
+	// shared slots held now, and the most held at once this collection; atomic
+	sharedHeld, sharedPeak int64
+	startTime              time.Time
+	startTimeDesc          *prometheus.Desc
 	totalScrapes           prometheus.Counter
+	maxLabelLength         int
+	teamlessProjects       string
+	retryQueuePasses       int
+	retryMax               int
+	retryBaseDelay         time.Duration
+	retryMaxDelay          time.Duration
+	retryJitter            float64
+	retryRecovered         prometheus.Counter
+	collectOwnership       bool
+	owners                 *ttlCache
+	minScrapeInterval      time.Duration
+	scrapeTimeout          time.Duration
+	collectLock            sync.Mutex
+	lastCollection         time.Time
+	cachedMetrics          []prometheus.Metric
+	coalescedScrapes       prometheus.Counter
+	sanitizedLabels        prometheus.Counter
+	lastCollectionDesc     *prometheus.Desc
+	lastSuccess            time.Time
+	lastSuccessDesc        *prometheus.Desc
+	collectKeys            bool
+	maxKeysPerProject      int
+	keyStatDesc            *prometheus.Desc
+	alignBuckets           bool
+	enumTimeout            time.Duration
+	statsTimeout           time.Duration
+	pageSize               int
+	pageSizeDesc           *prometheus.Desc
+	knownProjects          map[string]bool
+	topologyCacheTTL       time.Duration
+	topology               *topology
+	projectsAdded          prometheus.Counter
+	projectsRemoved        prometheus.Counter
+	sourceLabel            bool
+	schemaAnomalies        *prometheus.CounterVec
+	apiErrors              *prometheus.CounterVec
+	projectStatErrors      *prometheus.CounterVec
+	requestDuration        *prometheus.HistogramVec
+	groupByTag             string
+	groupTags              *ttlCache
+	pager                  pager
+	emitRatios             bool
+	emitStatBuckets        bool
+	statBucketsDesc        *prometheus.Desc
+	savedQueries           []savedQueryRef
+	limiter                *rate.Limiter
+	throttle               *throttle
+	rateLimited            prometheus.Counter
+	rateLimitDesc          *prometheus.Desc
+	// set once a collection has reached sentry; atomic
+	reachedSentry int32
+	// float64 bits of the fraction of project stats the last collection
+	// fetched; atomic
+	successRatio uint64
+	// requests sent to sentry during the current collection; atomic
+	requests         int64
+	observedRateDesc *prometheus.Desc
+	// the subset of collectedProjectStats to fetch
+	projectStats        map[string]sentry.StatQuery
+	configuredStatsDesc *prometheus.Desc
+	// the stat resolution and window queried with
+	statResolutionDesc *prometheus.Desc
+	statWindowDesc     *prometheus.Desc
+	projectSeries      bool
+	emitDistribution   bool
+	distributionDesc   *prometheus.Desc
+	// each project's received count for the current collection
+	distributionLock sync.Mutex
+	distribution     map[string]float64
+	// whether to emit each project's ingestion state
+	collectProjectStates bool
+	ingestionEnabledDesc *prometheus.Desc
+	// whether to emit each project's issue counts
+	collectIssues bool
+	issuesDesc    *prometheus.Desc
+	// whether to emit the rate limits of each project's client keys
+	collectRateLimits   bool
+	rateLimitCountDesc  *prometheus.Desc
+	rateLimitWindowDesc *prometheus.Desc
+	// whether to emit the most recent releases of each project, and how many
+	collectReleases       bool
+	maxReleasesPerProject int
+	releaseInfoDesc       *prometheus.Desc
+	releaseNewIssuesDesc  *prometheus.Desc
+	// whether to emit organization and team member counts
+	collectMembership bool
+	orgMembersDesc    *prometheus.Desc
+	teamMembersDesc   *prometheus.Desc
+	// if set, the end of the day being backfilled rather than now
+	backfillUntil time.Time
+	// if split by type, the per stat type replacements for projectStatDesc
+	splitByType   bool
+	statTypeDescs map[string]*prometheus.Desc
+	upSemantics   string
+	authOKDesc    *prometheus.Desc
+	orgUpDesc     *prometheus.Desc
+	// organization pagination progress
+	lastPageDesc           *prometheus.Desc
+	paginationCompleteDesc *prometheus.Desc
+	// most requests a collection may send, 0 for no limit
+	requestBudget int64
+	// set once a request is refused for the budget; atomic
+	budgetExceeded     int32
+	budgetExceededDesc *prometheus.Desc
+	orgsFailedDesc     *prometheus.Desc
+	scrapeAllocDesc    *prometheus.Desc
+	// organizations, teams, and projects enqueued during the last collection
+	orgsScrapedDesc, teamsScrapedDesc, projectsScrapedDesc *prometheus.Desc
+	// shardCount > 0 adds a shard label to project metrics; shard >= 0 restricts
+	// them to that shard
+	shardCount, shard int
+	// whether to also fetch stored event counts
+	collectStored bool
+	aggregateMode string
+	// organization slugs to collect, if non empty, and to skip
+	includeOrganizations, excludeOrganizations map[string]bool
+	// path.Match patterns of project slugs to collect, if non empty, and to skip
+	includeProjects, excludeProjects []string
+	// most projects a collection fetches stats for, 0 for no limit
+	maxProjects            int
+	maxProjectsReachedDesc *prometheus.Desc
+	// stat types fetched at once per project, and when that's above 1, a slot
+	// per stat fetch in flight, sized to maxFetchConccurrency
+	statConcurrency int
+	fetchSlots      chan struct{}
 }
 
 // Describe visit all prometheus.Desc contained in this exporter
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.projectStatDesc
+	for _, desc := range e.statTypeDescs {
+		ch <- desc
+	}
+	ch <- e.rejectionRatioDesc
+	ch <- e.statBucketsDesc
+	ch <- e.savedQueryDesc
+	ch <- e.rateLimitDesc
+	ch <- e.configuredStatsDesc
+	ch <- e.statResolutionDesc
+	ch <- e.statWindowDesc
+	ch <- e.distributionDesc
+	ch <- e.ingestionEnabledDesc
+	ch <- e.issuesDesc
+	ch <- e.rateLimitCountDesc
+	ch <- e.rateLimitWindowDesc
+	ch <- e.releaseInfoDesc
+	ch <- e.releaseNewIssuesDesc
+	ch <- e.orgMembersDesc
+	ch <- e.teamMembersDesc
+	ch <- e.observedRateDesc
+	ch <- e.keyStatDesc
 	ch <- e.sentryUp
+	ch <- e.authOKDesc
+	ch <- e.orgUpDesc
+	ch <- e.lastPageDesc
+	ch <- e.paginationCompleteDesc
+	ch <- e.budgetExceededDesc
+	ch <- e.maxProjectsReachedDesc
+	ch <- e.orgsFailedDesc
+	ch <- e.orgsScrapedDesc
+	ch <- e.teamsScrapedDesc
+	ch <- e.projectsScrapedDesc
+	ch <- e.scrapeAllocDesc
 	ch <- e.scrapeDurationDesc
+	ch <- e.workerIdleDesc
+	ch <- e.workerBusyDesc
+	ch <- e.saturationDesc
+	ch <- e.effectiveConcurrencyDesc
+	ch <- e.startTimeDesc
+	ch <- e.pageSizeDesc
 	ch <- e.totalScrapes.Desc()
+	ch <- e.retryRecovered.Desc()
+	ch <- e.coalescedScrapes.Desc()
+	ch <- e.lastCollectionDesc
+	ch <- e.lastSuccessDesc
+	ch <- e.projectsAdded.Desc()
+	ch <- e.projectsRemoved.Desc()
+	ch <- e.sanitizedLabels.Desc()
+	e.schemaAnomalies.Describe(ch)
+	e.apiErrors.Describe(ch)
+	e.projectStatErrors.Describe(ch)
+	e.requestDuration.Describe(ch)
+	ch <- e.rateLimited.Desc()
 }
 
 // Collect visit all prometheus metrics contained in this exporter
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	start := time.Now()
-	defer func() {
-		ch <- prometheus.MustNewConstMetric(
-			e.scrapeDurationDesc,
-			prometheus.GaugeValue,
-			time.Since(start).Seconds(),
-		)
-	}()
-	e.collectOrganizations(ch)
+	e.collectLock.Lock()
+	defer e.collectLock.Unlock()
+	if e.minScrapeInterval > 0 && time.Since(e.lastCollection) < e.minScrapeInterval {
+		log.Debugf("last collection was %s ago, serving its results", time.Since(e.lastCollection))
+		e.coalescedScrapes.Inc()
+		for _, m := range e.cachedMetrics {
+			ch <- m
+		}
+	} else {
+		e.collect(ch)
+	}
 	e.totalScrapes.Inc()
 	ch <- e.totalScrapes
+	ch <- e.retryRecovered
+	ch <- e.coalescedScrapes
+	ch <- e.projectsAdded
+	ch <- e.projectsRemoved
+	ch <- e.sanitizedLabels
+	e.schemaAnomalies.Collect(ch)
+	e.apiErrors.Collect(ch)
+	e.projectStatErrors.Collect(ch)
+	e.requestDuration.Collect(ch)
+	ch <- e.rateLimited
+	ch <- prometheus.MustNewConstMetric(
+		e.lastCollectionDesc,
+		prometheus.GaugeValue,
+		float64(e.lastCollection.Unix()),
+	)
+	var lastSuccess float64
+	if !e.lastSuccess.IsZero() {
+		lastSuccess = float64(e.lastSuccess.Unix())
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.lastSuccessDesc,
+		prometheus.GaugeValue,
+		lastSuccess,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.startTimeDesc,
+		prometheus.GaugeValue,
+		float64(e.startTime.Unix()),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.pageSizeDesc,
+		prometheus.GaugeValue,
+		float64(e.pageSize),
+	)
+	var limit float64
+	if e.limiter != nil {
+		limit = float64(e.limiter.Limit())
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.configuredStatsDesc,
+		prometheus.GaugeValue,
+		float64(len(e.projectStats)),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.statResolutionDesc,
+		prometheus.GaugeValue,
+		statResolutions[e.statResolution].Seconds(),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.statWindowDesc,
+		prometheus.GaugeValue,
+		e.statResolutionDuration.Seconds(),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.rateLimitDesc,
+		prometheus.GaugeValue,
+		limit,
+	)
+}
+
+// collect pull everything from sentry, caching the results for reuse if a
+// minimum scrape interval is configured.
+func (e *Exporter) collect(ch chan<- prometheus.Metric) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	allocStart := memStats.TotalAlloc
+	e.lastCollection = time.Now()
+	e.cachedMetrics = nil
+	metrics := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for m := range metrics {
+			cached := m
+			if sourced, ok := m.(*sourcedMetric); ok {
+				m, cached = sourced.Metric, sourced.cached
+			}
+			if e.minScrapeInterval > 0 {
+				e.cachedMetrics = append(e.cachedMetrics, cached)
+			}
+			ch <- m
+		}
+	}()
+
+	e.distribution = make(map[string]float64)
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if e.scrapeTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), e.scrapeTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	// the organization walk and saved queries are independent, so they run
+	// concurrently; metrics is safe for concurrent sends.
+	var collectors sync.WaitGroup
+	collectors.Add(1)
+	go func() {
+		defer collectors.Done()
+		e.collectSavedQueries(ctx, metrics)
+	}()
+	summary := e.collectOrganizations(ctx, metrics)
+	collectors.Wait()
+	if summary.up {
+		e.lastSuccess = e.lastCollection
+	}
+	successRatio := 1.0
+	if summary.statFetches > 0 {
+		successRatio -= float64(summary.statsUnfetched) / float64(summary.statFetches)
+	}
+	atomic.StoreUint64(&e.successRatio, math.Float64bits(successRatio))
+	if e.emitDistribution {
+		metrics <- e.distributionHistogram()
+	}
+	duration := time.Since(e.lastCollection).Seconds()
+	requests := atomic.SwapInt64(&e.requests, 0)
+	budgetExceeded := atomic.SwapInt32(&e.budgetExceeded, 0)
+	if budgetExceeded != 0 {
+		log.Warnf("collection ran out of its budget of %d requests; results are partial", e.requestBudget)
+	}
+	runtime.ReadMemStats(&memStats)
+	metrics <- prometheus.MustNewConstMetric(
+		e.scrapeAllocDesc,
+		prometheus.GaugeValue,
+		float64(memStats.TotalAlloc-allocStart),
+	)
+	metrics <- prometheus.MustNewConstMetric(
+		e.budgetExceededDesc,
+		prometheus.GaugeValue,
+		float64(budgetExceeded),
+	)
+	metrics <- prometheus.MustNewConstMetric(
+		e.scrapeDurationDesc,
+		prometheus.GaugeValue,
+		duration,
+	)
+	metrics <- prometheus.MustNewConstMetric(
+		e.observedRateDesc,
+		prometheus.GaugeValue,
+		float64(requests)/duration,
+	)
+	close(metrics)
+	<-done
+	log.WithFields(log.Fields{
+		"duration":      time.Since(e.lastCollection).String(),
+		"organizations": summary.organizations,
+		"teams":         summary.teams,
+		"projects":      summary.projects,
+		"fetch_errors":  summary.fetchErrors,
+		"retries":       summary.retries,
+		"success_ratio": successRatio,
+		"up":            summary.up,
+	}).Info("collection finished")
+}
+
+// Ready returns if any collection has reached sentry yet.  It doesn't query
+// sentry itself.
+func (e *Exporter) Ready() bool {
+	return atomic.LoadInt32(&e.reachedSentry) == 1
+}
+
+// SuccessRatio returns the fraction of project stats the last collection
+// fetched, after retries; 1 before any collection.  It doesn't query sentry
+// itself.
+func (e *Exporter) SuccessRatio() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&e.successRatio))
+}
+
+// sourcedMetric is a metric carrying a source="live" label, along with the
+// source="cache" variant to store for serving from cache.
+type sourcedMetric struct {
+	prometheus.Metric
+	cached prometheus.Metric
 }
 
 type projectFetchJob struct {
 	organization sentry.Organization
 	project      sentry.Project
-	team         sentry.Team
+	// team is nil for projects that aren't assigned to any team.
+	team *sentry.Team
+	// firstTeam is the slug of the first team listing the project, if any.
+	firstTeam string
+	// platform is the project's configured platform, or "" if it has none.
+	platform string
+	// statTypes restricts the fetch to these configured stat types; nil means
+	// all of them.
+	statTypes []string
+	retry     bool
 }
 
-func (e *Exporter) collectOrganizations(ch chan<- prometheus.Metric) {
+// scrapeSummary is what a collection covered, for the per scrape log line
+type scrapeSummary struct {
+	organizations, teams, projects int
+	fetchErrors, retries           int64
+	// project stats the collection set out to fetch, and how many of them
+	// it didn't manage to once retries were done; atomic
+	statFetches, statsUnfetched int64
+	up                          bool
+}
+
+func (e *Exporter) collectOrganizations(ctx context.Context, ch chan<- prometheus.Metric) (summary scrapeSummary) {
 	var wg sync.WaitGroup
 	log.Debug("spawning organization")
-	organizations, link, err := e.client.GetOrganizations()
+	var organizations []sentry.Organization
+	var next string
+	var err error
+	// organization listing pages fetched, and whether all of them were.
+	var pages int
+	cached := e.cachedTopology()
+	if cached != nil {
+		log.Debugf("using the cached topology of %d projects", len(cached.jobs))
+		pages = cached.pages
+	} else {
+		err = e.withRetries(ctx, "organization listing", func() (err error) {
+			start := time.Now()
+			next, err = e.pager.fetchPage(ctx, e.pagedPath("organizations/"), &organizations)
+			e.observeRequest("get_organizations", start)
+			return err
+		})
+		e.countAPIError("get_organizations", err)
+		if err == nil {
+			pages = 1
+		}
+	}
 
 	// note: go-sentry-api doesn't use pointers in a sane way, so this has to do
 	// a *lot* of copying.  Upstream API has to improve for this to improve.
 	workQueue := make(chan *projectFetchJob, e.maxFetchConccurrency)
+	// nanoseconds the workers spent blocked waiting for work, and working.
+	var idleTime, busyTime int64
+	// workers currently fetching, and the most that were at once.
+	var inflight, peakInflight int64
+	// jobs tracks enqueued jobs that haven't finished; stat fetches that failed
+	// are collected into retryQueue for another pass once everything finishes.
+	var jobs sync.WaitGroup
+	var retryLock sync.Mutex
+	var retryQueue []*projectFetchJob
+	// project ID's enumerated this scrape, and whether enumeration was partial.
+	var enumeratedLock sync.Mutex
+	enumerated := make(map[string]bool)
+	// teams enumerated this scrape, by organization and team slug
+	teams := make(map[string]bool)
+	var enumerationFailed bool
+	// jobs enqueued and organization details pulled by enumeration, for the
+	// topology cache
+	var discovered []*projectFetchJob
+	var orgDetails []*sentry.Organization
+	// projects handed to the workers, when there's a cap on them, and whether
+	// any were skipped for it
+	queued := make(map[string]bool)
+	var projectsCapped bool
+	// client keys, fetched at most once per project
+	clientKeys := newClientKeyCache()
+	enqueue := func(job *projectFetchJob) {
+		// other shards' projects are skipped before they're counted anywhere.
+		if !e.projectWanted(*job.project.Slug) || !e.inShard(job.project.ID) {
+			return
+		}
+		if ctx.Err() != nil {
+			enumeratedLock.Lock()
+			enumerationFailed = true
+			enumeratedLock.Unlock()
+			return
+		}
+		if !job.retry {
+			enumeratedLock.Lock()
+			discovered = append(discovered, job)
+			enumerated[job.project.ID] = true
+			if job.team != nil {
+				teams[*job.organization.Slug+"/"+*job.team.Slug] = true
+			}
+			// skipped projects are still recorded above, so they don't count
+			// as removed or drop out of the topology cache.
+			capped := e.maxProjects > 0 && !queued[job.project.ID] && len(queued) >= e.maxProjects
+			if capped {
+				projectsCapped = true
+			} else if e.maxProjects > 0 {
+				queued[job.project.ID] = true
+			}
+			enumeratedLock.Unlock()
+			if capped {
+				return
+			}
+		}
+		jobs.Add(1)
+		workQueue <- job
+	}
 	defer func() {
 		close(workQueue)
 		wg.Wait()
+		ch <- prometheus.MustNewConstMetric(
+			e.workerIdleDesc,
+			prometheus.GaugeValue,
+			time.Duration(idleTime).Seconds(),
+		)
+		ch <- prometheus.MustNewConstMetric(
+			e.workerBusyDesc,
+			prometheus.GaugeValue,
+			time.Duration(busyTime).Seconds(),
+		)
+		ch <- prometheus.MustNewConstMetric(
+			e.saturationDesc,
+			prometheus.GaugeValue,
+			float64(peakInflight)/float64(e.maxFetchConccurrency),
+		)
+		if e.sharedConcurrency != nil {
+			ch <- prometheus.MustNewConstMetric(
+				e.effectiveConcurrencyDesc,
+				prometheus.GaugeValue,
+				float64(atomic.SwapInt64(&e.sharedPeak, 0)),
+			)
+		}
 	}()
 
 	for i := uint32(0); i < e.maxFetchConccurrency; i++ {
@@ -75,45 +641,226 @@ func (e *Exporter) collectOrganizations(ch chan<- prometheus.Metric) {
 		go func() {
 			defer wg.Done()
 			for {
+				waitStart := time.Now()
 				work, more := <-workQueue
+				workStart := time.Now()
+				atomic.AddInt64(&idleTime, int64(workStart.Sub(waitStart)))
 				if !more {
 					return
 				}
-				e.collectProjectStats(ch, &work.organization, &work.team, &work.project)
+				if ctx.Err() != nil {
+					// the scrape timed out; drain the queue without fetching.
+					// first pass jobs fetch every stat type
+					if !work.retry {
+						atomic.AddInt64(&summary.statFetches, int64(len(e.projectStats)))
+						atomic.AddInt64(&summary.statsUnfetched, int64(len(e.projectStats)))
+					}
+					jobs.Done()
+					continue
+				}
+				storeMax(&peakInflight, atomic.AddInt64(&inflight, 1))
+				e.acquireShared(true)
+				if e.fetchSlots != nil {
+					e.fetchSlots <- struct{}{}
+				}
+				failed := e.collectProjectStats(ctx, ch, work, clientKeys)
+				if e.fetchSlots != nil {
+					<-e.fetchSlots
+				}
+				e.releaseShared()
+				atomic.AddInt64(&inflight, -1)
+				atomic.AddInt64(&summary.fetchErrors, int64(len(failed)))
+				if work.retry {
+					e.retryRecovered.Add(float64(len(work.statTypes) - len(failed)))
+					atomic.AddInt64(&summary.statsUnfetched, -int64(len(work.statTypes)-len(failed)))
+				} else {
+					atomic.AddInt64(&summary.statFetches, int64(len(e.projectStats)))
+					atomic.AddInt64(&summary.statsUnfetched, int64(len(failed)))
+				}
+				if len(failed) != 0 {
+					retryLock.Lock()
+					retryQueue = append(retryQueue, &projectFetchJob{
+						organization: work.organization,
+						project:      work.project,
+						team:         work.team,
+						firstTeam:    work.firstTeam,
+						platform:     work.platform,
+						statTypes:    failed,
+						retry:        true,
+					})
+					retryLock.Unlock()
+				}
+				jobs.Done()
+				atomic.AddInt64(&busyTime, int64(time.Since(workStart)))
+			}
+		}()
+	}
+
+	// organization details are pulled by their own pool, which feeds workQueue;
+	// it's drained before any retry passes, and before workQueue is closed.
+	orgQueue := make(chan string, e.maxOrgConcurrency)
+	// organizations that couldn't be enumerated
+	var orgsFailed int64
+	var orgWorkers sync.WaitGroup
+	for i := uint32(0); i < e.maxOrgConcurrency; i++ {
+		orgWorkers.Add(1)
+		go func() {
+			defer orgWorkers.Done()
+			for slug := range orgQueue {
+				org, err := e.enumerateOrganization(ctx, slug, enqueue)
+				orgUp := float64(1)
+				if err != nil {
+					orgUp = 0
+					atomic.AddInt64(&orgsFailed, 1)
+					enumeratedLock.Lock()
+					enumerationFailed = true
+					enumeratedLock.Unlock()
+				}
+				ch <- prometheus.MustNewConstMetric(
+					e.orgUpDesc,
+					prometheus.GaugeValue,
+					orgUp,
+					e.labelValues(slug)...,
+				)
+				if org == nil {
+					continue
+				}
+				enumeratedLock.Lock()
+				orgDetails = append(orgDetails, org)
+				enumeratedLock.Unlock()
+				if e.collectMembership {
+					e.collectMembers(ctx, ch, org)
+				}
 			}
 		}()
 	}
 
 	for len(organizations) != 0 && err == nil {
 		for orgIdx := range organizations {
-			// repull the org; API doesn't give us useful results, but
-			// GetOrganization gets the team/project listing we want.
-			org, err := e.client.GetOrganization(*(organizations[orgIdx].Slug))
-			if err != nil {
-				log.Errorf("failed pulling organization details for %s: err %s", (*organizations[orgIdx].Slug), err)
+			if e.anomalous("organization.slug", organizations[orgIdx].Slug == nil, "organization "+organizations[orgIdx].Name) {
+				atomic.AddInt64(&orgsFailed, 1)
+				enumeratedLock.Lock()
+				enumerationFailed = true
+				enumeratedLock.Unlock()
 				continue
 			}
-			for _, team := range *(org.Teams) {
-
-				for _, project := range *(team.Projects) {
-					workQueue <- &projectFetchJob{
-						organization: org,
-						project:      project,
-						team:         team,
-					}
-				}
+			if !e.organizationWanted(*organizations[orgIdx].Slug) {
+				log.Debugf("skipping filtered organization %s", *organizations[orgIdx].Slug)
+				continue
+			}
+			orgQueue <- *(organizations[orgIdx].Slug)
+			summary.organizations++
+		}
+		if next == "" {
+			break
+		}
+		organizations = nil
+		page := next
+		err = e.withRetries(ctx, "organization listing", func() (err error) {
+			start := time.Now()
+			next, err = e.pager.fetchPage(ctx, page, &organizations)
+			e.observeRequest("get_organizations", start)
+			return err
+		})
+		e.countAPIError("get_organizations", err)
+		log.Debugf("organization pagination of %s had next page %q, err=%v", page, next, err)
+		if err == nil {
+			pages++
+		}
+	}
+	paginationComplete := float64(0)
+	if err == nil && next == "" {
+		paginationComplete = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.lastPageDesc,
+		prometheus.GaugeValue,
+		float64(pages),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.paginationCompleteDesc,
+		prometheus.GaugeValue,
+		paginationComplete,
+	)
+	close(orgQueue)
+	orgWorkers.Wait()
+	if cached != nil {
+		for _, job := range cached.jobs {
+			enqueue(job)
+		}
+		summary.organizations = cached.organizations
+		// the topology is only cached when every organization was pulled.
+		for _, org := range cached.orgDetails {
+			ch <- prometheus.MustNewConstMetric(
+				e.orgUpDesc,
+				prometheus.GaugeValue,
+				1,
+				e.labelValues(*org.Slug)...,
+			)
+			if e.collectMembership {
+				e.collectMembers(ctx, ch, org)
 			}
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.orgsFailedDesc,
+		prometheus.GaugeValue,
+		float64(orgsFailed),
+	)
+	maxProjectsReached := float64(0)
+	if projectsCapped {
+		log.Warnf("collection reached its limit of %d projects; the rest were skipped", e.maxProjects)
+		maxProjectsReached = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.maxProjectsReachedDesc,
+		prometheus.GaugeValue,
+		maxProjectsReached,
+	)
+	if err == nil && !enumerationFailed {
+		e.updateKnownProjects(enumerated)
+		if cached == nil && e.topologyCacheTTL > 0 {
+			e.topology = &topology{
+				jobs:          discovered,
+				orgDetails:    orgDetails,
+				organizations: summary.organizations,
+				pages:         pages,
+				expires:       time.Now().Add(e.topologyCacheTTL),
+			}
+		}
+	}
 
+	for pass := 1; pass <= e.retryQueuePasses; pass++ {
+		jobs.Wait()
+		if ctx.Err() != nil {
+			break
 		}
-		if !link.Next.Results {
+		retryLock.Lock()
+		queued := retryQueue
+		retryQueue = nil
+		retryLock.Unlock()
+		if len(queued) == 0 {
 			break
 		}
-		link, err = e.client.GetPage(link.Next, organizations)
-		log.Debugf("organization pagination results were %v, err=%v", link, err)
+		log.Debugf("retry pass %d for %d projects with failed stat fetches", pass, len(queued))
+		summary.retries += int64(len(queued))
+		for _, job := range queued {
+			enqueue(job)
+		}
+	}
+
+	upVal, authVal := float64(1), float64(1)
+	if isAuthError(err) {
+		authVal = 0
 	}
-	upVal := float64(1)
 	if err != nil {
 		log.Errorf("failed spawning organizations: %s", err)
+		if authVal == 1 || e.upSemantics != UpReachability {
+			upVal = 0
+		}
+	}
+	if ctx.Err() != nil {
+		log.Warnf("collection exceeded the scrape timeout of %s; results are partial", e.scrapeTimeout)
 		upVal = 0
 	}
 	log.Debug("finished organizations")
@@ -122,60 +869,535 @@ func (e *Exporter) collectOrganizations(ch chan<- prometheus.Metric) {
 		prometheus.GaugeValue,
 		upVal,
 	)
+	ch <- prometheus.MustNewConstMetric(
+		e.authOKDesc,
+		prometheus.GaugeValue,
+		authVal,
+	)
+	summary.up = upVal == 1
+	if summary.up {
+		atomic.StoreInt32(&e.reachedSentry, 1)
+	}
+	summary.teams, summary.projects = len(teams), len(enumerated)
+	for desc, value := range map[*prometheus.Desc]int{
+		e.orgsScrapedDesc:     summary.organizations,
+		e.teamsScrapedDesc:    summary.teams,
+		e.projectsScrapedDesc: summary.projects,
+	} {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(value))
+	}
+	return summary
+}
+
+// updateKnownProjects count projects added and removed since the last complete
+// enumeration.  The first enumeration just establishes the baseline.
+func (e *Exporter) updateKnownProjects(enumerated map[string]bool) {
+	if e.knownProjects != nil {
+		for id := range enumerated {
+			if !e.knownProjects[id] {
+				e.projectsAdded.Inc()
+			}
+		}
+		for id := range e.knownProjects {
+			if !enumerated[id] {
+				e.projectsRemoved.Inc()
+			}
+		}
+	}
+	e.knownProjects = enumerated
+}
+
+// enumerateOrganization enqueue a projectFetchJob for every project of the organization,
+// returning an error if not all of them could be enumerated.  The organization's
+// details are returned if they could be fetched, even if enumeration failed after.
+func (e *Exporter) enumerateOrganization(ctx context.Context, slug string, enqueue func(*projectFetchJob)) (*sentry.Organization, error) {
+	// repull the org; API doesn't give us useful results, but
+	// GetOrganization gets the team/project listing we want.
+	var org sentry.Organization
+	err := e.withRetries(ctx, "organization "+slug, func() (err error) {
+		client, cancel := e.clientWithTimeout(ctx, e.enumTimeout)
+		defer cancel()
+		start := time.Now()
+		org, err = client.GetOrganization(slug)
+		e.observeRequest("get_organization", start)
+		return err
+	})
+	if e.countAPIError("get_organization", err) != nil {
+		log.WithField("organization", slug).WithField("operation", "get_organization").WithField("error", err).Error("failed pulling organization details")
+		return nil, err
+	}
+	context := "organization " + slug
+	if e.anomalous("organization.slug", org.Slug == nil, context) || e.anomalous("organization.id", org.ID == nil, context) {
+		return nil, fmt.Errorf("organization %s is missing required fields", slug)
+	}
+	var teams []sentry.Team
+	if !e.anomalous("organization.teams", org.Teams == nil, context) {
+		teams = *(org.Teams)
+	}
+	// the project listing is the only place with the projects' configured
+	// platforms, and the only way to find projects without a team.
+	projects, listErr := e.getOrganizationProjects(ctx, &org)
+	if listErr != nil {
+		log.WithField("organization", *org.Slug).WithField("operation", "get_page").WithField("error", listErr).Warn("failed pulling project listing, platform labels will be empty and projects without a team won't be collected")
+	}
+	platforms := make(map[string]string, len(projects))
+	for _, project := range projects {
+		if project.Platform != nil {
+			platforms[project.ID] = *project.Platform
+		}
+	}
+	// first team slug for each project ID seen via the team walk; anything
+	// else in the org's project listing doesn't belong to any team.
+	firstTeams := make(map[string]string)
+	for teamIdx := range teams {
+		context := fmt.Sprintf("team %s of organization %s", teams[teamIdx].Name, slug)
+		if e.anomalous("team.slug", teams[teamIdx].Slug == nil, context) ||
+			e.anomalous("team.id", teams[teamIdx].ID == nil, context) ||
+			e.anomalous("team.projects", teams[teamIdx].Projects == nil, context) {
+			continue
+		}
+		for _, project := range *(teams[teamIdx].Projects) {
+			if e.anomalous("project.slug", project.Slug == nil, "project "+project.ID) {
+				continue
+			}
+			if _, seen := firstTeams[project.ID]; !seen {
+				firstTeams[project.ID] = *(teams[teamIdx].Slug)
+			}
+			enqueue(&projectFetchJob{
+				organization: org,
+				project:      project,
+				team:         &teams[teamIdx],
+				firstTeam:    firstTeams[project.ID],
+				platform:     platforms[project.ID],
+			})
+		}
+	}
+
+	if listErr != nil {
+		return &org, listErr
+	}
+	if e.teamlessProjects == TeamlessProjectsDrop {
+		return &org, nil
+	}
+	for _, project := range projects {
+		if _, seen := firstTeams[project.ID]; seen {
+			continue
+		}
+		if e.anomalous("project.slug", project.Slug == nil, "project "+project.ID) {
+			continue
+		}
+		firstTeams[project.ID] = ""
+		enqueue(&projectFetchJob{
+			organization: org,
+			project:      project.Project,
+			platform:     platforms[project.ID],
+		})
+	}
+	return &org, nil
+}
+
+// projectLabelNames labels identifying the project of every per project metric
+var projectLabelNames = []string{"organization_slug", "organization_id", "team_slug", "team_id", "project_slug", "project_id"}
+
+// projectLabels returns the values for projectLabelNames for the job's project.
+func (e *Exporter) projectLabels(job *projectFetchJob) []string {
+	var teamSlug, teamID string
+	if job.team != nil {
+		teamSlug, teamID = *(job.team.Slug), *(job.team.ID)
+	} else if e.teamlessProjects == TeamlessProjectsPlaceholder {
+		teamSlug = TeamlessPlaceholder
+	}
+	return []string{
+		*(job.organization.Slug),
+		*(job.organization.ID),
+		teamSlug,
+		teamID,
+		*(job.project.Slug),
+		job.project.ID,
+	}
+}
+
+// projectLog returns a logger carrying the organization and project slugs as
+// fields, so structured output doesn't need them parsed out of the message.
+func projectLog(organization *sentry.Organization, project *sentry.Project) *log.Entry {
+	return log.WithField("organization", *organization.Slug).WithField("project", *project.Slug)
 }
 
-func (e *Exporter) collectProjectStats(ch chan<- prometheus.Metric, organization *sentry.Organization, team *sentry.Team, project *sentry.Project) {
-	log.Debugf("spawning project stats pull for organization %s, team %s, project %s", *(organization.Slug), *(team.Slug), *(project.Slug))
+// collectProjectStats fetch the job's stat types (all if nil) for its project,
+// returning the stat types that couldn't be fetched.  Client keys come from
+// keyCache, shared across the collection's jobs.
+func (e *Exporter) collectProjectStats(ctx context.Context, ch chan<- prometheus.Metric, job *projectFetchJob, keyCache *clientKeyCache) (failed []string) {
+	organization, project, statTypes := &job.organization, &job.project, job.statTypes
+	// sanitized once here so the collectors sharing them don't count it again
+	baseLabels := e.labelValues(e.projectLabels(job)...)
+	teamSlug := baseLabels[2]
+	log.Debugf("spawning project stats pull for organization %s, team %s, project %s", *(organization.Slug), teamSlug, *(project.Slug))
+	// labels following type that only depend on the project
+	extraLabels := []string{job.platform}
+	if e.collectOwnership {
+		extraLabels = append(extraLabels, e.projectOwner(ctx, organization, project, job.firstTeam))
+	}
+	if e.groupByTag != "" {
+		extraLabels = append(extraLabels, e.projectTagValue(ctx, organization, project))
+	}
+	if e.shardCount > 0 {
+		extraLabels = append(extraLabels, strconv.Itoa(projectShard(project.ID, e.shardCount)))
+	}
 	until := time.Now()
+	if !e.backfillUntil.IsZero() {
+		until = e.backfillUntil
+	} else if e.alignBuckets {
+		until = until.Truncate(statResolutions[e.statResolution])
+	}
 	since := until.Add(-e.statResolutionDuration)
-	for eventType, statQuery := range collectedProjectStats {
-		stats, err := e.client.GetProjectStats(
-			*organization,
-			*project,
-			statQuery,
-			since.Unix(),
-			until.Unix(),
-			&e.statResolution,
-		)
+	if statTypes == nil {
+		for eventType := range e.projectStats {
+			statTypes = append(statTypes, eventType)
+		}
+	}
+	// the last bucket of each stat type that was fetched
+	lastStats := make(map[string]sentry.Stat, len(statTypes))
+	// the number of buckets each fetched stat type returned
+	buckets := make(map[string]int, len(statTypes))
+	var lastStatsLock sync.Mutex
+	e.fetchStatTypes(statTypes, func(eventType string) {
+		stats, err := e.getProjectStats(ctx, organization, project, e.projectStats[eventType], since, until)
+		lastStatsLock.Lock()
+		defer lastStatsLock.Unlock()
 		if err != nil {
-			log.Warnf("failed fetching stat type %s for project %s; err %s", eventType, *project.Slug, err)
+			projectLog(organization, project).WithField("stat_type", eventType).WithField("operation", "get_project_stats").WithField("error", err).Warn("failed fetching project stats")
+			e.projectStatErrors.WithLabelValues(e.labelValues(append(append([]string{}, baseLabels...), eventType)...)...).Inc()
+			failed = append(failed, eventType)
 		} else if len(stats) == 0 {
-			log.Warnf("requested stat type %s for project %s returned no results", eventType, *project.Slug)
+			// an empty series without an error means nothing was recorded,
+			// so it's reported as zero for the latest bucket.
+			log.Debugf("stat type %s for project %s returned no buckets, reporting 0", eventType, *project.Slug)
+			buckets[eventType] = 0
+			lastStats[eventType] = sentry.Stat{float64(until.Truncate(statResolutions[e.statResolution]).Unix()), 0}
 		} else {
 			log.Debugf("stat type %s for project %s returned %v", eventType, *project.Slug, stats)
-			lastStat := stats[len(stats)-1]
-			ch <- prometheus.NewMetricWithTimestamp(
-				time.Unix(int64(lastStat[0]), 0),
-				prometheus.MustNewConstMetric(
-					e.projectStatDesc,
-					prometheus.GaugeValue,
-					lastStat[1],
-					*(organization.Slug),
-					*(organization.ID),
-					*(team.Slug),
-					*(team.ID),
-					*(project.Slug),
-					project.ID,
-					eventType,
-				),
+			buckets[eventType] = len(stats)
+			lastStats[eventType] = e.aggregate(stats)
+		}
+	})
+	if e.projectSeries {
+		for eventType, lastStat := range lastStats {
+			if desc, ok := e.statTypeDescs[eventType]; ok {
+				labels := append(append([]string{}, baseLabels...), extraLabels...)
+				e.sendProjectMetric(ch, desc, lastStat, labels)
+				continue
+			}
+			labels := append(append([]string{}, baseLabels...), eventType)
+			if e.collectStored {
+				dimension := "received"
+				if eventType == storedStatType {
+					labels[len(labels)-1], dimension = "received", "stored"
+				}
+				labels = append(labels, dimension)
+			}
+			e.sendProjectMetric(ch, e.projectStatDesc, lastStat, append(labels, extraLabels...))
+		}
+	}
+	if e.emitStatBuckets {
+		for eventType, count := range buckets {
+			ch <- prometheus.MustNewConstMetric(
+				e.statBucketsDesc,
+				prometheus.GaugeValue,
+				float64(count),
+				e.labelValues(append(append([]string{}, baseLabels...), eventType)...)...,
 			)
 		}
 	}
-	log.Debugf("finished project stats pull for organization %s, team %s, project %s", *(organization.Slug), *(team.Slug), *(project.Slug))
+	if received, ok := lastStats["received"]; ok && e.emitDistribution {
+		// keyed by project so projects in several teams are only counted once.
+		e.distributionLock.Lock()
+		e.distribution[project.ID] = received[1]
+		e.distributionLock.Unlock()
+	}
+	if e.emitRatios {
+		received, haveReceived := lastStats["received"]
+		rejected, haveRejected := lastStats["rejected"]
+		// only compare buckets covering the same period.
+		if haveReceived && haveRejected && received[0] == rejected[0] {
+			ratio := sentry.Stat{received[0], 0}
+			if received[1] != 0 {
+				ratio[1] = rejected[1] / received[1]
+			}
+			labels := append(append([]string{}, baseLabels...), extraLabels...)
+			e.sendProjectMetric(ch, e.rejectionRatioDesc, ratio, labels)
+		}
+	}
+	clientKeys := keyCache.fetcher(ctx, e, job)
+	if e.collectKeys && !job.retry {
+		e.collectKeyStats(ctx, ch, job, clientKeys, baseLabels, since, until)
+	}
+	if e.collectProjectStates && !job.retry {
+		e.collectProjectState(ch, job, clientKeys, baseLabels)
+	}
+	if e.collectRateLimits && !job.retry {
+		e.collectKeyRateLimits(ch, clientKeys, baseLabels)
+	}
+	if e.collectReleases && !job.retry {
+		e.collectProjectReleases(ctx, ch, job, baseLabels)
+	}
+	if e.collectIssues && !job.retry {
+		e.collectIssueCounts(ctx, ch, job, baseLabels)
+	}
+	log.Debugf("finished project stats pull for organization %s, team %s, project %s", *(organization.Slug), teamSlug, *(project.Slug))
+	return failed
+}
+
+// distributionBuckets are the upper bounds of the project events distribution
+var distributionBuckets = prometheus.ExponentialBuckets(1, 10, 8)
+
+// distributionHistogram returns the histogram of the collection's per project
+// received counts
+func (e *Exporter) distributionHistogram() prometheus.Metric {
+	e.distributionLock.Lock()
+	defer e.distributionLock.Unlock()
+	buckets := make(map[float64]uint64, len(distributionBuckets))
+	var sum float64
+	for _, received := range e.distribution {
+		sum += received
+		for _, bound := range distributionBuckets {
+			if received <= bound {
+				buckets[bound]++
+			}
+		}
+	}
+	return prometheus.MustNewConstHistogram(
+		e.distributionDesc,
+		uint64(len(e.distribution)),
+		sum,
+		buckets,
+	)
+}
+
+// SetFilters replace the organization and project filters, as
+// WithOrganizationFilter and WithProjectFilter set them.  It waits out any
+// collection in progress, and drops the topology cache so the next collection
+// enumerates with the new filters.  Invalid filters leave the current ones be.
+func (e *Exporter) SetFilters(includeOrganizations, excludeOrganizations, includeProjects, excludeProjects []string) error {
+	var updated Exporter
+	if err := WithOrganizationFilter(includeOrganizations, excludeOrganizations)(&updated); err != nil {
+		return err
+	}
+	if err := WithProjectFilter(includeProjects, excludeProjects)(&updated); err != nil {
+		return err
+	}
+	e.collectLock.Lock()
+	defer e.collectLock.Unlock()
+	e.includeOrganizations, e.excludeOrganizations = updated.includeOrganizations, updated.excludeOrganizations
+	e.includeProjects, e.excludeProjects = updated.includeProjects, updated.excludeProjects
+	e.topology = nil
+	return nil
+}
+
+// organizationWanted returns if the organization passes the organization filters
+func (e *Exporter) organizationWanted(slug string) bool {
+	if len(e.includeOrganizations) != 0 && !e.includeOrganizations[slug] {
+		return false
+	}
+	return !e.excludeOrganizations[slug]
+}
+
+// projectWanted returns if the project passes the project filters
+func (e *Exporter) projectWanted(slug string) bool {
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			// patterns are validated up front.
+			if matched, _ := path.Match(pattern, slug); matched {
+				return true
+			}
+		}
+		return false
+	}
+	if len(e.includeProjects) != 0 && !matches(e.includeProjects) {
+		return false
+	}
+	return !matches(e.excludeProjects)
+}
+
+// projectShard returns the shard in [0, shards) the project belongs to; it's stable
+// across restarts and exporter instances.
+func projectShard(projectID string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(projectID))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// inShard returns if the project belongs to the shard being collected, if
+// collection is restricted to one.
+func (e *Exporter) inShard(projectID string) bool {
+	return e.shardCount <= 0 || e.shard < 0 || projectShard(projectID, e.shardCount) == e.shard
+}
+
+// aggregate reduce the stat buckets for a window to the single stat exported;
+// for sums the timestamp is zeroed.
+func (e *Exporter) aggregate(stats []sentry.Stat) sentry.Stat {
+	if e.aggregateMode != AggregateSum {
+		return stats[len(stats)-1]
+	}
+	var sum sentry.Stat
+	for _, stat := range stats {
+		sum[1] += stat[1]
+	}
+	return sum
+}
+
+// sendProjectMetric emit a project gauge for stat, marked with its source if the
+// source label is enabled.
+func (e *Exporter) sendProjectMetric(ch chan<- prometheus.Metric, desc *prometheus.Desc, stat sentry.Stat, labels []string) {
+	statMetric := func(labels ...string) prometheus.Metric {
+		metric := prometheus.MustNewConstMetric(
+			desc,
+			prometheus.GaugeValue,
+			stat[1],
+			labels...,
+		)
+		// a sum covers the whole window rather than a bucket, so it has no
+		// timestamp of its own.
+		if e.aggregateMode == AggregateSum {
+			return metric
+		}
+		return prometheus.NewMetricWithTimestamp(time.Unix(int64(stat[0]), 0), metric)
+	}
+	// labelValues hands back an exactly sized copy, so live and cache below
+	// don't share a backing array.
+	labels = e.labelValues(labels...)
+	if !e.sourceLabel {
+		ch <- statMetric(labels...)
+		return
+	}
+	ch <- &sourcedMetric{
+		Metric: statMetric(append(labels, "live")...),
+		cached: statMetric(append(labels, "cache")...),
+	}
 }
 
 // NewExporter create a new sentry exporter
-func NewExporter(client *sentry.Client, maxFetchConccurrency uint32, namespace string) (*Exporter, error) {
-	projectLabels := []string{"organization_slug", "organization_id", "team_slug", "team_id", "project_slug", "project_id", "type"}
-	return &Exporter{
+func NewExporter(client SentryClient, maxFetchConccurrency uint32, namespace string, options ...Option) (*Exporter, error) {
+	e := &Exporter{
 		client:                 client,
 		maxFetchConccurrency:   maxFetchConccurrency,
+		maxOrgConcurrency:      1,
+		statConcurrency:        1,
 		statResolution:         "10s",
 		statResolutionDuration: time.Second * 15,
-		projectStatDesc: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "project", "events_count"),
-			"project count for received events of a given type",
-			projectLabels,
+		teamlessProjects:       TeamlessProjectsPlaceholder,
+		owners:                 newTTLCache(ownershipCacheTTL),
+		groupTags:              newTTLCache(groupTagCacheTTL),
+		projectStats:           registeredStatTypes(),
+		projectSeries:          true,
+		distributionDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "project", "events_distribution"),
+			"distribution of received event counts across projects for the last stat bucket",
+			nil,
+			nil,
+		),
+		configuredStatsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "configured_stat_types"),
+			"number of project stat types the exporter is configured to collect",
+			nil,
+			nil,
+		),
+		statResolutionDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "stat", "resolution_seconds"),
+			"bucket size in seconds project stats are requested with",
+			nil,
+			nil,
+		),
+		statWindowDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "stat", "window_seconds"),
+			"seconds of project stats requested, ending at the collection time",
+			nil,
+			nil,
+		),
+		rateLimitDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "rate_limit_requests_per_second"),
+			"configured limit on requests per second sent to sentry, 0 if unlimited",
+			nil,
+			nil,
+		),
+		observedRateDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "last_collection_requests_per_second"),
+			"requests per second sent to sentry during the last collection",
+			nil,
+			nil,
+		),
+		savedQueryDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "saved_query_result"),
+			"number of result rows from running a saved discover query",
+			[]string{"organization_slug", "query_id"},
+			nil,
+		),
+		upSemantics:   UpFullyFunctional,
+		shard:         -1,
+		aggregateMode: AggregateLast,
+		scrapeAllocDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "scrape_alloc_bytes"),
+			"bytes of heap allocated during the last collection, by the whole process",
+			nil,
+			nil,
+		),
+		orgsFailedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "orgs_failed"),
+			"number of organizations that couldn't be enumerated during the last collection",
+			nil,
+			nil,
+		),
+		orgsScrapedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "organizations_scraped"),
+			"number of organizations that passed the filters during the last collection",
+			nil,
+			nil,
+		),
+		teamsScrapedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "teams_scraped"),
+			"number of teams with projects enqueued during the last collection",
+			nil,
+			nil,
+		),
+		projectsScrapedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "projects_scraped"),
+			"number of projects enqueued during the last collection, once filtered",
+			nil,
+			nil,
+		),
+		maxProjectsReachedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "max_projects_reached"),
+			"boolean, 1 if the last collection skipped projects past its project limit",
+			nil,
+			nil,
+		),
+		budgetExceededDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "request_budget_exceeded"),
+			"boolean, 1 if the last collection ran out of its request budget and is partial",
+			nil,
+			nil,
+		),
+		lastPageDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "last_page_reached"),
+			"number of organization listing pages fetched during the last collection",
+			nil,
+			nil,
+		),
+		paginationCompleteDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "last_pagination_complete"),
+			"boolean, 1 if the last collection fetched every organization listing page",
+			nil,
+			nil,
+		),
+		authOKDesc: prometheus.NewDesc(
+			fmt.Sprintf("%s_auth_ok", namespace),
+			"boolean, 0 if sentry rejected the auth token, 1 if not",
+			nil,
+			nil,
+		),
+		orgUpDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "organization", "up"),
+			"boolean, 1 if the organization's details and projects could be pulled, zero if not",
+			[]string{"organization_slug"},
 			nil,
 		),
 		sentryUp: prometheus.NewDesc(
@@ -190,11 +1412,259 @@ func NewExporter(client *sentry.Client, maxFetchConccurrency uint32, namespace s
 			nil,
 			nil,
 		),
+		workerIdleDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "worker_idle_seconds"),
+			"total seconds stat fetch workers spent waiting for work during the last scrape",
+			nil,
+			nil,
+		),
+		workerBusyDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "worker_busy_seconds"),
+			"total seconds stat fetch workers spent fetching stats during the last scrape",
+			nil,
+			nil,
+		),
+		saturationDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "concurrency_saturation"),
+			"peak number of concurrent stat fetches during the last scrape, as a ratio of the maximum allowed",
+			nil,
+			nil,
+		),
+		effectiveConcurrencyDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "effective_concurrency"),
+			"most of the shared stat fetch concurrency slots held at once during the last scrape",
+			nil,
+			nil,
+		),
+		startTime:    time.Now(),
+		successRatio: math.Float64bits(1),
+		startTimeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "start_time_seconds"),
+			"unix time the exporter started at",
+			nil,
+			nil,
+		),
+		pageSizeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "page_size"),
+			"page size requested when paginating sentry listings, 0 if sentry's default",
+			nil,
+			nil,
+		),
+		lastCollectionDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "last_real_collection_timestamp_seconds"),
+			"unix time sentry was last actually queried, rather than served from cache",
+			nil,
+			nil,
+		),
+		lastSuccessDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "last_success_timestamp_seconds"),
+			"unix time the last collection with sentry_up 1 started, 0 if there hasn't been one",
+			nil,
+			nil,
+		),
 		totalScrapes: prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace: namespace,
 			Subsystem: "exporter",
 			Name:      "scrapes_total",
 			Help:      "total number of scrapes",
 		}),
-	}, nil
+		retryRecovered: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "retry_queue_recovered_total",
+			Help:      "total number of project stat fetches that failed but succeeded on a retry pass",
+		}),
+		coalescedScrapes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "coalesced_scrapes_total",
+			Help:      "total number of scrapes served the previous collection's results because they arrived within the minimum scrape interval",
+		}),
+		sanitizedLabels: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "sanitized_labels_total",
+			Help:      "total number of label values that had invalid UTF-8 or control characters replaced",
+		}),
+		projectsAdded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "projects_added_total",
+			Help:      "total number of projects that appeared since the previous complete enumeration",
+		}),
+		projectsRemoved: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "projects_removed_total",
+			Help:      "total number of projects that disappeared since the previous complete enumeration",
+		}),
+		schemaAnomalies: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "schema_anomalies_total",
+			Help:      "total number of sentry API responses missing a required field, by field",
+		}, []string{"field"}),
+		projectStatErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "project",
+			Name:      "stat_errors_total",
+			Help:      "total number of the project's stat requests of a given type that failed, rather than returning no events",
+		}, append(append([]string{}, projectLabelNames...), "type")),
+		apiErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "api_errors_total",
+			Help:      "total number of failed sentry API requests, by operation",
+		}, []string{"operation"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "api",
+			Name:      "request_duration_seconds",
+			Help:      "duration of sentry API requests, by operation",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation"}),
+		rateLimited: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rate_limited_total",
+			Help:      "total number of requests sentry rejected with a 429 for rate limiting",
+		}),
+	}
+	// pause once sentry reports fewer requests left than the workers could
+	// have in flight.
+	e.throttle = &throttle{lowWater: int(maxFetchConccurrency), rateLimited: e.rateLimited}
+	// initialize every operation so the series exist before the first error.
+	for _, operation := range apiOperations {
+		e.apiErrors.WithLabelValues(operation)
+	}
+	// timeouts default to the http client's own, where there is one.
+	if sentryClient, ok := client.(*sentry.Client); ok && sentryClient.HTTPClient != nil {
+		e.enumTimeout, e.statsTimeout = sentryClient.HTTPClient.Timeout, sentryClient.HTTPClient.Timeout
+	}
+	for _, option := range options {
+		if err := option(e); err != nil {
+			return nil, err
+		}
+	}
+	if e.retryMaxDelay > 0 && e.retryBaseDelay > e.retryMaxDelay {
+		return nil, fmt.Errorf("retry base delay %s is over the max delay of %s", e.retryBaseDelay, e.retryMaxDelay)
+	}
+	if e.statConcurrency > 1 {
+		e.fetchSlots = make(chan struct{}, e.maxFetchConccurrency)
+	}
+	if len(e.projectStats) == 0 {
+		return nil, fmt.Errorf("no project stat types are configured")
+	}
+	e.pager = &clientPager{exporter: e, timeout: e.enumTimeout}
+
+	// labels that follow type on project metrics
+	extraLabels := []string{"platform"}
+	if e.collectOwnership {
+		extraLabels = append(extraLabels, "owner")
+	}
+	if e.groupByTag != "" {
+		extraLabels = append(extraLabels, tagLabelName(e.groupByTag))
+	}
+	if e.shardCount > 0 {
+		extraLabels = append(extraLabels, "shard")
+	}
+	if e.sourceLabel {
+		extraLabels = append(extraLabels, "source")
+	}
+	statLabels := append(append([]string{}, projectLabelNames...), "type")
+	if e.collectStored {
+		projectStats := map[string]sentry.StatQuery{storedStatType: "generated"}
+		for statType, query := range e.projectStats {
+			projectStats[statType] = query
+		}
+		e.projectStats = projectStats
+		statLabels = append(statLabels, "dimension")
+	}
+	statSuffix, helpSuffix := "_count", ""
+	if e.aggregateMode == AggregateSum {
+		statSuffix, helpSuffix = "_window", ", summed over the stat window"
+	}
+	e.projectStatDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "project", "events"+statSuffix),
+		"project count for received events of a given type"+helpSuffix,
+		append(statLabels, extraLabels...),
+		nil,
+	)
+	if e.splitByType {
+		e.statTypeDescs = make(map[string]*prometheus.Desc, len(e.projectStats))
+		for statType := range e.projectStats {
+			e.statTypeDescs[statType] = prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, "project", statType+statSuffix),
+				fmt.Sprintf("project count for %s events%s", statType, helpSuffix),
+				append(append([]string{}, projectLabelNames...), extraLabels...),
+				nil,
+			)
+		}
+	}
+	e.rejectionRatioDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "project", "rejection_ratio"),
+		"ratio of rejected to received events for the project's last stat bucket, 0 if nothing was received",
+		append(append([]string{}, projectLabelNames...), extraLabels...),
+		nil,
+	)
+	e.statBucketsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "project", "stat_buckets"),
+		"number of buckets sentry returned for the project's stats of a given type, for the stat window",
+		append(append([]string{}, projectLabelNames...), "type"),
+		nil,
+	)
+	e.ingestionEnabledDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "project", "ingestion_enabled"),
+		"boolean, 1 if the project is active and has an enabled client key, 0 if sentry will drop its events",
+		projectLabelNames,
+		nil,
+	)
+	e.issuesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "project", "issues"),
+		"number of the project's issues with a given status",
+		append(append([]string{}, projectLabelNames...), "status"),
+		nil,
+	)
+	e.keyStatDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "project", "key_events_count"),
+		"client key (DSN) count for events of a given type",
+		append(append([]string{}, projectLabelNames...), "key_id", "key_label", "type"),
+		nil,
+	)
+	e.rateLimitCountDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "project", "rate_limit_count"),
+		"events the client key (DSN) accepts per rate limit window",
+		append(append([]string{}, projectLabelNames...), "key_id", "key_label"),
+		nil,
+	)
+	e.rateLimitWindowDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "project", "rate_limit_window_seconds"),
+		"length of the client key's (DSN) rate limit window",
+		append(append([]string{}, projectLabelNames...), "key_id", "key_label"),
+		nil,
+	)
+	e.releaseInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "release", "info"),
+		"always 1, labeled with one of the project's most recent releases and when it was created",
+		append(append([]string{}, projectLabelNames...), "version", "date_created"),
+		nil,
+	)
+	e.releaseNewIssuesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "release", "new_issues"),
+		"number of issues first seen in the release",
+		append(append([]string{}, projectLabelNames...), "version"),
+		nil,
+	)
+	e.orgMembersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "organization", "members"),
+		"number of members of the organization",
+		[]string{"organization_slug", "organization_id"},
+		nil,
+	)
+	e.teamMembersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "team", "members"),
+		"number of members of the team",
+		[]string{"organization_slug", "organization_id", "team_slug", "team_id"},
+		nil,
+	)
+	return e, nil
 }
@@ -0,0 +1,652 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/go-sentry-api"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakePage is a canned GetPage response; next is the path of the following page,
+// if any.
+type fakePage struct {
+	body interface{}
+	next string
+	err  error
+}
+
+// fakeClient is a SentryClient serving canned organizations and pages by path.
+// Paths without a canned page are an empty listing, apart from project stats,
+// which are a single bucket.  Set it up before collecting; only requests is
+// written to afterwards.
+type fakeClient struct {
+	organizations map[string]sentry.Organization
+	orgErrors     map[string]error
+	pages         map[string]fakePage
+	// how long GetOrganization takes
+	orgDelay time.Duration
+
+	mu       sync.Mutex
+	requests []string
+	// GetOrganization calls in flight, and the most there were at once
+	orgInflight, orgPeak int
+}
+
+var _ SentryClient = (*fakeClient)(nil)
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		organizations: make(map[string]sentry.Organization),
+		orgErrors:     make(map[string]error),
+		pages:         make(map[string]fakePage),
+	}
+}
+
+// serve add the organizations to the fake's organization listing and details,
+// listing each one's team projects as its projects.
+func (c *fakeClient) serve(organizations ...sentry.Organization) {
+	listing, _ := c.pages["organizations/"].body.([]sentry.Organization)
+	for _, org := range organizations {
+		c.organizations[*org.Slug] = org
+		listing = append(listing, sentry.Organization{Slug: org.Slug, ID: org.ID, Name: org.Name})
+		var projects []sentry.Project
+		seen := make(map[string]bool)
+		if org.Teams != nil {
+			for _, team := range *org.Teams {
+				if team.Projects == nil {
+					continue
+				}
+				for _, project := range *team.Projects {
+					if !seen[project.ID] {
+						seen[project.ID] = true
+						projects = append(projects, project)
+					}
+				}
+			}
+		}
+		if org.Slug != nil {
+			c.pages["organizations/"+*org.Slug+"/projects/"] = fakePage{body: projects}
+		}
+	}
+	c.pages["organizations/"] = fakePage{body: listing}
+}
+
+func (c *fakeClient) record(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, path)
+}
+
+// requested returns the paths requested so far, in order
+func (c *fakeClient) requested() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.requests...)
+}
+
+func (c *fakeClient) GetOrganization(slug string) (sentry.Organization, error) {
+	c.record("organizations/" + slug + "/")
+	c.mu.Lock()
+	c.orgInflight++
+	if c.orgInflight > c.orgPeak {
+		c.orgPeak = c.orgInflight
+	}
+	c.mu.Unlock()
+	time.Sleep(c.orgDelay)
+	c.mu.Lock()
+	c.orgInflight--
+	c.mu.Unlock()
+	if err := c.orgErrors[slug]; err != nil {
+		return sentry.Organization{}, err
+	}
+	org, ok := c.organizations[slug]
+	if !ok {
+		return sentry.Organization{}, sentry.APIError{StatusCode: 404}
+	}
+	return org, nil
+}
+
+func (c *fakeClient) GetPage(p sentry.Page, out interface{}) (*sentry.Link, error) {
+	c.record(p.URL)
+	path := strings.SplitN(p.URL, "?", 2)[0]
+	page, ok := c.pages[p.URL]
+	if !ok {
+		page, ok = c.pages[path]
+	}
+	if !ok {
+		page.body = []interface{}{}
+		if strings.HasPrefix(path, "projects/") && strings.HasSuffix(path, "/stats/") {
+			page.body = []sentry.Stat{{float64(time.Now().Unix()), 1}}
+		}
+	}
+	if page.err != nil {
+		return nil, page.err
+	}
+	body, err := json.Marshal(page.body)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return nil, err
+	}
+	if page.next == "" {
+		return nil, nil
+	}
+	return &sentry.Link{Next: sentry.Page{URL: page.next, Results: true}}, nil
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func testOrganization(slug string, teams ...sentry.Team) sentry.Organization {
+	return sentry.Organization{Slug: stringPtr(slug), ID: stringPtr("org-" + slug), Name: slug, Teams: &teams}
+}
+
+func testTeam(slug string, projects ...sentry.Project) sentry.Team {
+	return sentry.Team{Slug: stringPtr(slug), ID: stringPtr("team-" + slug), Name: slug, Projects: &projects}
+}
+
+func testProject(slug string) sentry.Project {
+	return sentry.Project{Slug: stringPtr(slug), ID: "project-" + slug, Name: slug}
+}
+
+func newTestExporter(t *testing.T, client SentryClient, options ...Option) *Exporter {
+	t.Helper()
+	e, err := NewExporter(client, 4, "sentry", options...)
+	if err != nil {
+		t.Fatalf("NewExporter failed: %s", err)
+	}
+	return e
+}
+
+// gather collect e through a registry, which also checks the metrics are
+// consistent, returning the metric families by name.
+func gather(t *testing.T, e *Exporter) map[string]*dto.MetricFamily {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(e); err != nil {
+		t.Fatalf("registering the exporter failed: %s", err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("gathering failed: %s", err)
+	}
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	return byName
+}
+
+// gaugeValue returns the value of the metric family's single series
+func gaugeValue(t *testing.T, families map[string]*dto.MetricFamily, name string) float64 {
+	t.Helper()
+	family, ok := families[name]
+	if !ok || len(family.GetMetric()) != 1 {
+		t.Fatalf("expected a single %s series, got %v", name, family)
+	}
+	return family.GetMetric()[0].GetGauge().GetValue()
+}
+
+func labelValue(metric *dto.Metric, name string) string {
+	for _, pair := range metric.GetLabel() {
+		if pair.GetName() == name {
+			return pair.GetValue()
+		}
+	}
+	return ""
+}
+
+// seriesByLabel returns the family's series keyed by the value of label
+func seriesByLabel(families map[string]*dto.MetricFamily, name, label string) map[string][]*dto.Metric {
+	series := make(map[string][]*dto.Metric)
+	for _, metric := range families[name].GetMetric() {
+		series[labelValue(metric, label)] = append(series[labelValue(metric, label)], metric)
+	}
+	return series
+}
+
+func TestCollectWithFakeClient(t *testing.T) {
+	client := newFakeClient()
+	client.serve(testOrganization("acme", testTeam("backend", testProject("api"), testProject("worker"))))
+	families := gather(t, newTestExporter(t, client))
+
+	if up := gaugeValue(t, families, "sentry_up"); up != 1 {
+		t.Errorf("sentry_up = %v, want 1", up)
+	}
+	projects := seriesByLabel(families, "sentry_project_events_count", "project_slug")
+	for _, slug := range []string{"api", "worker"} {
+		if got, want := len(projects[slug]), len(registeredStatTypes()); got != want {
+			t.Errorf("project %s has %d event series, want one per stat type (%d)", slug, got, want)
+		}
+	}
+}
+
+func TestNilFieldsAreSkipped(t *testing.T) {
+	client := newFakeClient()
+	noSlugTeam := testTeam("")
+	noSlugTeam.Slug = nil
+	noProjectsTeam := testTeam("frontend")
+	noProjectsTeam.Projects = nil
+	noSlugProject := testProject("")
+	noSlugProject.Slug = nil
+	client.serve(testOrganization("acme",
+		testTeam("backend", testProject("api"), noSlugProject),
+		noSlugTeam,
+		noProjectsTeam,
+	))
+	// an organization listed without a slug, and one whose details lack teams
+	listing := client.pages["organizations/"].body.([]sentry.Organization)
+	client.pages["organizations/"] = fakePage{body: append(listing, sentry.Organization{Name: "noslug"})}
+	noTeams := testOrganization("globex")
+	noTeams.Teams = nil
+	client.serve(noTeams)
+
+	families := gather(t, newTestExporter(t, client))
+
+	anomalies := seriesByLabel(families, "sentry_exporter_schema_anomalies_total", "field")
+	for _, field := range []string{"organization.slug", "organization.teams", "team.slug", "team.projects", "project.slug"} {
+		if len(anomalies[field]) != 1 || anomalies[field][0].GetCounter().GetValue() == 0 {
+			t.Errorf("expected a schema anomaly to be counted for %s, got %v", field, anomalies[field])
+		}
+	}
+	if projects := seriesByLabel(families, "sentry_project_events_count", "project_slug"); len(projects) != 1 || projects["api"] == nil {
+		t.Errorf("expected only project api to be collected, got %v", projects)
+	}
+}
+
+func TestPaginationErrorMidway(t *testing.T) {
+	client := newFakeClient()
+	client.serve(testOrganization("acme", testTeam("backend", testProject("api"))))
+	first := client.pages["organizations/"]
+	first.next = "organizations/?cursor=2"
+	client.pages["organizations/"] = first
+	client.pages["organizations/?cursor=2"] = fakePage{err: sentry.APIError{StatusCode: 502, Detail: "bad gateway"}}
+
+	// several org workers, so enumeration is still running when the listing
+	// fails.
+	families := gather(t, newTestExporter(t, client, WithOrgConcurrency(4), WithRetryQueuePasses(1)))
+
+	if up := gaugeValue(t, families, "sentry_up"); up != 0 {
+		t.Errorf("sentry_up = %v, want 0 after the listing failed", up)
+	}
+	if complete := gaugeValue(t, families, "sentry_exporter_last_pagination_complete"); complete != 0 {
+		t.Errorf("sentry_exporter_last_pagination_complete = %v, want 0", complete)
+	}
+	if pages := gaugeValue(t, families, "sentry_exporter_last_page_reached"); pages != 1 {
+		t.Errorf("sentry_exporter_last_page_reached = %v, want 1", pages)
+	}
+	if projects := seriesByLabel(families, "sentry_project_events_count", "project_slug"); projects["api"] == nil {
+		t.Errorf("expected the first page's project to still be collected, got %v", projects)
+	}
+}
+
+func TestTeamlessProject(t *testing.T) {
+	for _, test := range []struct {
+		mode     string
+		teamSlug string
+		dropped  bool
+	}{
+		{mode: TeamlessProjectsPlaceholder, teamSlug: TeamlessPlaceholder},
+		{mode: TeamlessProjectsEmpty, teamSlug: ""},
+		{mode: TeamlessProjectsDrop, dropped: true},
+	} {
+		t.Run(test.mode, func(t *testing.T) {
+			client := newFakeClient()
+			client.serve(testOrganization("acme", testTeam("backend", testProject("api"))))
+			// the organization's project listing has every project, teamless or not.
+			client.pages["organizations/acme/projects/"] = fakePage{body: []sentry.Project{testProject("api"), testProject("orphan")}}
+			families := gather(t, newTestExporter(t, client, WithTeamlessProjects(test.mode)))
+
+			projects := seriesByLabel(families, "sentry_project_events_count", "project_slug")
+			stats := len(registeredStatTypes())
+			if got := len(projects["api"]); got != stats {
+				t.Errorf("project api has %d series, want %d; it should only be reported under its team", got, stats)
+			}
+			if test.dropped {
+				if projects["orphan"] != nil {
+					t.Errorf("expected the teamless project to be dropped, got %v", projects["orphan"])
+				}
+				return
+			}
+			if got := len(projects["orphan"]); got != stats {
+				t.Fatalf("teamless project has %d series, want %d", got, stats)
+			}
+			for _, metric := range projects["orphan"] {
+				if team := labelValue(metric, "team_slug"); team != test.teamSlug {
+					t.Errorf("teamless project has team_slug %q, want %q", team, test.teamSlug)
+				}
+			}
+		})
+	}
+}
+
+func TestOrganizationPool(t *testing.T) {
+	const organizations, concurrency = 12, 3
+	client := newFakeClient()
+	client.orgDelay = 10 * time.Millisecond
+	for i := 0; i < organizations; i++ {
+		client.serve(testOrganization(fmt.Sprintf("org%d", i), testTeam(fmt.Sprintf("team%d", i), testProject(fmt.Sprintf("project%d", i)))))
+	}
+	families := gather(t, newTestExporter(t, client, WithOrgConcurrency(concurrency)))
+
+	if client.orgPeak > concurrency {
+		t.Errorf("%d organizations were pulled at once, more than the concurrency of %d", client.orgPeak, concurrency)
+	}
+	if client.orgPeak < 2 {
+		t.Errorf("organizations were pulled one at a time despite a concurrency of %d", concurrency)
+	}
+	// every organization is pulled once, before any of its projects' stats.
+	pulled := make(map[string]int)
+	for i, path := range client.requested() {
+		parts := strings.Split(path, "/")
+		if len(parts) == 3 && parts[0] == "organizations" && parts[2] == "" {
+			pulled[parts[1]]++
+			continue
+		}
+		if len(parts) >= 4 && parts[0] == "projects" && strings.HasPrefix(parts[3], "stats") && pulled[parts[1]] == 0 {
+			t.Errorf("request %d fetched stats of project %s before organization %s was pulled", i, parts[2], parts[1])
+		}
+	}
+	projects := seriesByLabel(families, "sentry_project_events_count", "project_slug")
+	for i := 0; i < organizations; i++ {
+		if org := fmt.Sprintf("org%d", i); pulled[org] != 1 {
+			t.Errorf("organization %s was pulled %d times, want 1", org, pulled[org])
+		}
+		if project := fmt.Sprintf("project%d", i); len(projects[project]) != len(registeredStatTypes()) {
+			t.Errorf("project %s has %d series, want %d", project, len(projects[project]), len(registeredStatTypes()))
+		}
+	}
+	if scraped := gaugeValue(t, families, "sentry_organizations_scraped"); scraped != organizations {
+		t.Errorf("sentry_organizations_scraped = %v, want %d", scraped, organizations)
+	}
+}
+
+func TestPathologicalSlugs(t *testing.T) {
+	client := newFakeClient()
+	// GetOrganization hands back team projects as is, so invalid UTF-8 survives
+	// to the exporter; pages go through JSON, which would replace it, so the
+	// org listing is emptied to keep the JSON copy from showing up teamless.
+	project := testProject("bad\xff\x01slug")
+	client.serve(testOrganization("acme", testTeam("back\nend", project)))
+	client.pages["organizations/acme/projects/"] = fakePage{body: []sentry.Project{}}
+	families := gather(t, newTestExporter(t, client))
+
+	series := families["sentry_project_events_count"].GetMetric()
+	if len(series) == 0 {
+		t.Fatal("the project with a pathological slug wasn't collected")
+	}
+	for _, metric := range series {
+		if slug := labelValue(metric, "project_slug"); slug != "bad��slug" {
+			t.Errorf("project_slug = %q, want the invalid byte and control character replaced", slug)
+		}
+		if team := labelValue(metric, "team_slug"); team != "back�end" {
+			t.Errorf("team_slug = %q, want the newline replaced", team)
+		}
+	}
+	// project slug and ID, team slug and ID, counted once for the job rather
+	// than once per series
+	if sanitized := families["sentry_exporter_sanitized_labels_total"].GetMetric()[0].GetCounter().GetValue(); sanitized != 4 {
+		t.Errorf("sentry_exporter_sanitized_labels_total = %v, want 4", sanitized)
+	}
+}
+
+func TestSanitizeLabelValue(t *testing.T) {
+	for _, test := range []struct {
+		value, want string
+		sanitized   bool
+	}{
+		{"backend", "backend", false},
+		{"caf\u00e9", "caf\u00e9", false},
+		{"already\ufffdclean", "already\ufffdclean", false},
+		{"bad\xffbyte", "bad\ufffdbyte", true},
+		{"tab\tbed", "tab\ufffdbed", true},
+		{"\xff\ufffd", "\ufffd\ufffd", true},
+	} {
+		got, sanitized := sanitizeLabelValue(test.value)
+		if got != test.want || sanitized != test.sanitized {
+			t.Errorf("sanitizeLabelValue(%q) = %q, %v, want %q, %v", test.value, got, sanitized, test.want, test.sanitized)
+		}
+	}
+}
+
+func TestConcurrentCollectors(t *testing.T) {
+	client := newFakeClient()
+	client.serve(testOrganization("acme", testTeam("backend", testProject("api"))))
+	client.pages["organizations/acme/discover/saved/1/"] = fakePage{body: map[string]interface{}{
+		"fields": []string{"count()"},
+		"range":  "24h",
+	}}
+	client.pages["organizations/acme/events/"] = fakePage{body: map[string]interface{}{
+		"data": []map[string]interface{}{{"count()": 1}, {"count()": 2}},
+	}}
+	client.pages["organizations/acme/members/"] = fakePage{body: []map[string]string{{"id": "1"}, {"id": "2"}}}
+	client.pages["teams/acme/backend/members/"] = fakePage{body: []map[string]string{{"id": "1"}}}
+	families := gather(t, newTestExporter(t, client,
+		WithSavedQueries([]string{"acme:1"}),
+		WithMembership(true),
+	))
+
+	// the saved queries run alongside the organization walk; each side's
+	// metrics have to make it out.
+	for name, want := range map[string]float64{
+		"sentry_saved_query_result":    2,
+		"sentry_organization_members":  2,
+		"sentry_team_members":          1,
+		"sentry_organizations_scraped": 1,
+		"sentry_organization_up":       1,
+	} {
+		if got := gaugeValue(t, families, name); got != want {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+	if got := len(families["sentry_project_events_count"].GetMetric()); got != len(registeredStatTypes()) {
+		t.Errorf("got %d sentry_project_events_count series, want %d", got, len(registeredStatTypes()))
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	e := newTestExporter(t, newFakeClient(),
+		WithRetries(6, 500*time.Millisecond),
+		WithRetryBackoff(3*time.Second, 0),
+	)
+	for attempt, want := range []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		if got := e.retryDelay(attempt + 1); got != want {
+			t.Errorf("retryDelay(%d) = %s, want %s", attempt+1, got, want)
+		}
+	}
+
+	e = newTestExporter(t, newFakeClient(),
+		WithRetries(6, time.Second),
+		WithRetryBackoff(0, 0.5),
+	)
+	for i := 0; i < 100; i++ {
+		if got := e.retryDelay(2); got <= time.Second || got > 2*time.Second {
+			t.Fatalf("retryDelay(2) = %s with a jitter of 0.5, want within (1s, 2s]", got)
+		}
+	}
+
+	if _, err := NewExporter(newFakeClient(), 4, "sentry", WithRetries(1, time.Minute), WithRetryBackoff(time.Second, 0)); err == nil {
+		t.Error("NewExporter accepted a retry base delay over the max delay")
+	}
+}
+
+func TestSuccessRatio(t *testing.T) {
+	client := newFakeClient()
+	client.serve(testOrganization("acme", testTeam("backend", testProject("api"), testProject("worker"))))
+	client.pages["projects/acme/worker/stats/"] = fakePage{err: sentry.APIError{StatusCode: 500, Detail: "internal error"}}
+	e := newTestExporter(t, client)
+	if ratio := e.SuccessRatio(); ratio != 1 {
+		t.Errorf("SuccessRatio() before any collection = %v, want 1", ratio)
+	}
+	gather(t, e)
+	if ratio := e.SuccessRatio(); ratio != 0.5 {
+		t.Errorf("SuccessRatio() = %v, want 0.5 with one of two projects failing", ratio)
+	}
+}
+
+func TestSetFilters(t *testing.T) {
+	client := newFakeClient()
+	client.serve(
+		testOrganization("acme", testTeam("backend", testProject("api"), testProject("worker"))),
+		testOrganization("widgets", testTeam("frontend", testProject("web"))),
+	)
+	e := newTestExporter(t, client, WithTopologyCache(time.Hour), WithOrganizationFilter([]string{"acme"}, nil))
+	if projects := seriesByLabel(gather(t, e), "sentry_project_events_count", "project_slug"); len(projects) != 2 {
+		t.Fatalf("collected projects %v, want acme's two", projects)
+	}
+	if err := e.SetFilters(nil, []string{"acme"}, nil, nil); err != nil {
+		t.Fatalf("SetFilters failed: %s", err)
+	}
+	// the cached topology only covers acme, so it has to be dropped
+	projects := seriesByLabel(gather(t, e), "sentry_project_events_count", "project_slug")
+	if _, ok := projects["web"]; len(projects) != 1 || !ok {
+		t.Errorf("collected projects %v after swapping the filters, want only widgets' web", projects)
+	}
+	if err := e.SetFilters(nil, nil, []string{"["}, nil); err == nil {
+		t.Error("SetFilters accepted an invalid project pattern")
+	}
+}
+
+func TestSharedConcurrency(t *testing.T) {
+	shared := NewSharedConcurrency(2)
+	var exporters []*Exporter
+	for _, slug := range []string{"acme", "widgets"} {
+		client := newFakeClient()
+		client.serve(testOrganization(slug, testTeam("backend", testProject("api"), testProject("worker"), testProject("web"))))
+		exporters = append(exporters, newTestExporter(t, client, WithSharedConcurrency(shared), WithStatConcurrency(3)))
+	}
+	results := make([]map[string]*dto.MetricFamily, len(exporters))
+	var wg sync.WaitGroup
+	for i, e := range exporters {
+		wg.Add(1)
+		go func(i int, e *Exporter) {
+			defer wg.Done()
+			results[i] = gather(t, e)
+		}(i, e)
+	}
+	wg.Wait()
+	for _, families := range results {
+		if held := gaugeValue(t, families, "sentry_exporter_effective_concurrency"); held < 1 || held > 2 {
+			t.Errorf("sentry_exporter_effective_concurrency = %v, want within the shared cap of 2", held)
+		}
+		if got := len(families["sentry_project_events_count"].GetMetric()); got != 3*len(registeredStatTypes()) {
+			t.Errorf("got %d sentry_project_events_count series, want %d", got, 3*len(registeredStatTypes()))
+		}
+	}
+	if held := len(shared.slots); held != 0 {
+		t.Errorf("%d shared slots are still held after collecting", held)
+	}
+}
+
+func TestGroupByTagLabelNames(t *testing.T) {
+	for _, test := range []struct {
+		tag     string
+		wantErr bool
+	}{
+		{tag: "release"},
+		{tag: "sentry:release"},
+		{tag: "os.name"},
+		{tag: "1st_party", wantErr: true},
+		{tag: "__name__", wantErr: true},
+		{tag: "__custom", wantErr: true},
+		{tag: "project_slug", wantErr: true},
+	} {
+		_, err := NewExporter(newFakeClient(), 4, "sentry", WithGroupByTag(test.tag))
+		if (err != nil) != test.wantErr {
+			t.Errorf("WithGroupByTag(%q) error = %v, want error %v", test.tag, err, test.wantErr)
+		}
+	}
+}
+
+func TestAggregateSumName(t *testing.T) {
+	client := newFakeClient()
+	client.serve(testOrganization("acme", testTeam("backend", testProject("api"))))
+	families := gather(t, newTestExporter(t, client, WithAggregateMode(AggregateSum)))
+
+	family := families["sentry_project_events_window"]
+	if got := len(family.GetMetric()); got != len(registeredStatTypes()) {
+		t.Fatalf("got %d sentry_project_events_window series, want %d", got, len(registeredStatTypes()))
+	}
+	if family.GetType() != dto.MetricType_GAUGE {
+		t.Errorf("sentry_project_events_window is a %s, want a gauge", family.GetType())
+	}
+	for name := range families {
+		if name == "sentry_project_events_count" || name == "sentry_project_events_total" {
+			t.Errorf("sum mode exported %s", name)
+		}
+	}
+}
+
+func TestClientKeysFetchedOnce(t *testing.T) {
+	client := newFakeClient()
+	// api is listed by both teams, so it's collected twice
+	client.serve(testOrganization("acme",
+		testTeam("backend", testProject("api"), testProject("worker")),
+		testTeam("frontend", testProject("api")),
+	))
+	client.pages["projects/acme/api/keys/"] = fakePage{body: []map[string]interface{}{
+		{"id": "k1", "label": "default", "isActive": true, "rateLimit": map[string]float64{"window": 60, "count": 100}},
+	}}
+	client.pages["projects/acme/api/keys/k1/stats/"] = fakePage{body: []keyStat{{Timestamp: float64(time.Now().Unix()), Accepted: 1}}}
+	families := gather(t, newTestExporter(t, client, WithKeyStats(true, 0), WithProjectState(true), WithRateLimits(true)))
+
+	keyRequests := make(map[string]int)
+	for _, path := range client.requested() {
+		if strings.HasSuffix(path, "/keys/") {
+			keyRequests[path]++
+		}
+	}
+	for _, slug := range []string{"api", "worker"} {
+		if got := keyRequests["projects/acme/"+slug+"/keys/"]; got != 1 {
+			t.Errorf("requested the keys of project %s %d times, want once", slug, got)
+		}
+	}
+	// every collector still gets the keys it was handed
+	enabled := seriesByLabel(families, "sentry_project_ingestion_enabled", "project_slug")
+	if got := enabled["api"][0].GetGauge().GetValue(); got != 1 {
+		t.Errorf("api sentry_project_ingestion_enabled = %v, want 1", got)
+	}
+	if got := enabled["worker"][0].GetGauge().GetValue(); got != 0 {
+		t.Errorf("worker sentry_project_ingestion_enabled = %v, want 0", got)
+	}
+	// one per team listing api
+	if got := len(families["sentry_project_rate_limit_count"].GetMetric()); got != 2 {
+		t.Errorf("got %d sentry_project_rate_limit_count series, want 2", got)
+	}
+	if got := len(families["sentry_project_key_events_count"].GetMetric()); got != 6 {
+		t.Errorf("got %d sentry_project_key_events_count series, want 6", got)
+	}
+}
+
+func TestProjectPlatform(t *testing.T) {
+	client := newFakeClient()
+	api, worker := testProject("api"), testProject("worker")
+	// platforms is what sentry has seen in events, in no stable order; the
+	// label comes from the configured platform
+	api.Platforms = &[]string{"javascript", "python"}
+	client.serve(testOrganization("acme", testTeam("backend", api, worker)))
+	client.pages["organizations/acme/projects/"] = fakePage{body: []map[string]interface{}{
+		{"id": api.ID, "slug": "api", "platform": "python"},
+		{"id": worker.ID, "slug": "worker", "platform": nil},
+	}}
+	for _, mode := range []string{TeamlessProjectsPlaceholder, TeamlessProjectsDrop} {
+		families := gather(t, newTestExporter(t, client, WithTeamlessProjects(mode)))
+		projects := seriesByLabel(families, "sentry_project_events_count", "project_slug")
+		for slug, want := range map[string]string{"api": "python", "worker": ""} {
+			if len(projects[slug]) == 0 {
+				t.Fatalf("%s mode: no series for project %s", mode, slug)
+			}
+			if got := labelValue(projects[slug][0], "platform"); got != want {
+				t.Errorf("%s mode: project %s platform = %q, want %q", mode, slug, got, want)
+			}
+		}
+	}
+}
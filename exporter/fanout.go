@@ -0,0 +1,45 @@
+package exporter
+
+import "sync"
+
+// fetchStatTypes call fetch for each of the stat types, up to statConcurrency at
+// once.  The calling worker holds a fetch slot already; helpers only take slots
+// that are free rather than waiting on one, which keeps the stat requests in
+// flight within maxFetchConccurrency, and any shared concurrency cap, without
+// workers blocking on each other.
+func (e *Exporter) fetchStatTypes(statTypes []string, fetch func(statType string)) {
+	queue := make(chan string, len(statTypes))
+	for _, statType := range statTypes {
+		queue <- statType
+	}
+	close(queue)
+	drain := func() {
+		for statType := range queue {
+			fetch(statType)
+		}
+	}
+	var helpers sync.WaitGroup
+spawn:
+	for i := 1; e.fetchSlots != nil && i < e.statConcurrency && i < len(statTypes); i++ {
+		select {
+		case e.fetchSlots <- struct{}{}:
+		default:
+			break spawn
+		}
+		if !e.acquireShared(false) {
+			<-e.fetchSlots
+			break spawn
+		}
+		helpers.Add(1)
+		go func() {
+			defer helpers.Done()
+			defer func() {
+				e.releaseShared()
+				<-e.fetchSlots
+			}()
+			drain()
+		}()
+	}
+	drain()
+	helpers.Wait()
+}
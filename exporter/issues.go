@@ -0,0 +1,40 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/atlassian/go-sentry-api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// issueStatuses are the issue statuses sentry_project_issues is reported for
+var issueStatuses = []string{"unresolved", "resolved", "ignored"}
+
+// countIssues returns the number of the project's issues with the status
+func (e *Exporter) countIssues(ctx context.Context, organization *sentry.Organization, project *sentry.Project, status string) (int, error) {
+	query := url.Values{}
+	query.Add("query", "is:"+status)
+	// an empty period skips the per issue event stats, which aren't needed.
+	query.Add("statsPeriod", "")
+	query.Add("per_page", fmt.Sprint(maxPageSize))
+	return e.countListing(ctx, fmt.Sprintf("projects/%s/%s/issues/?%s", *organization.Slug, *project.Slug, query.Encode()))
+}
+
+// collectIssueCounts emit the project's issue count for each of issueStatuses
+func (e *Exporter) collectIssueCounts(ctx context.Context, ch chan<- prometheus.Metric, job *projectFetchJob, baseLabels []string) {
+	for _, status := range issueStatuses {
+		count, err := e.countIssues(ctx, &job.organization, &job.project, status)
+		if err != nil {
+			projectLog(&job.organization, &job.project).WithField("status", status).WithField("operation", "get_page").WithField("error", err).Warn("failed counting issues")
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.issuesDesc,
+			prometheus.GaugeValue,
+			float64(count),
+			e.labelValues(append(append([]string{}, baseLabels...), status)...)...,
+		)
+	}
+}
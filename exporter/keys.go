@@ -0,0 +1,137 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/atlassian/go-sentry-api"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// keyStat is a bucket from the client key stats endpoint, which go-sentry-api
+// doesn't support.
+type keyStat struct {
+	Timestamp float64 `json:"ts"`
+	Accepted  float64 `json:"accepted"`
+	Filtered  float64 `json:"filtered"`
+	Dropped   float64 `json:"dropped"`
+}
+
+// clientKey is a project client key (DSN), with the parts go-sentry-api doesn't
+// decode; RateLimit is nil for keys without a limit.
+type clientKey struct {
+	ID        string `json:"id"`
+	Label     string `json:"label"`
+	IsActive  bool   `json:"isActive"`
+	RateLimit *struct {
+		Window float64 `json:"window"`
+		Count  float64 `json:"count"`
+	} `json:"rateLimit"`
+}
+
+// clientKeyFetcher returns a function fetching the project's client keys on its
+// first call and handing back the same keys, or error, on later ones.  Failures
+// are logged once, by the first call.
+func (e *Exporter) clientKeyFetcher(ctx context.Context, job *projectFetchJob) func() ([]clientKey, error) {
+	var once sync.Once
+	var keys []clientKey
+	var err error
+	return func() ([]clientKey, error) {
+		once.Do(func() {
+			page := sentry.Page{URL: fmt.Sprintf("projects/%s/%s/keys/", *job.organization.Slug, *job.project.Slug)}
+			client, cancel := e.clientWithTimeout(ctx, e.enumTimeout)
+			start := time.Now()
+			_, err = client.GetPage(page, &keys)
+			e.observeRequest("get_client_keys", start)
+			cancel()
+			if e.countAPIError("get_client_keys", err) != nil {
+				projectLog(&job.organization, &job.project).WithField("operation", "get_client_keys").WithField("error", err).Warn("failed fetching client keys")
+			}
+		})
+		return keys, err
+	}
+}
+
+// clientKeyCache holds a collection's client key fetchers by project ID.  The key
+// stats, state and rate limit collectors share them, and a project listed by
+// several teams is collected once per team, so this is what keeps each scrape to
+// listing a project's keys once.
+type clientKeyCache struct {
+	lock     sync.Mutex
+	fetchers map[string]func() ([]clientKey, error)
+}
+
+func newClientKeyCache() *clientKeyCache {
+	return &clientKeyCache{fetchers: make(map[string]func() ([]clientKey, error))}
+}
+
+// fetcher returns the job's project's fetcher, creating it if it's the first ask
+func (c *clientKeyCache) fetcher(ctx context.Context, e *Exporter, job *projectFetchJob) func() ([]clientKey, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	fetch, ok := c.fetchers[job.project.ID]
+	if !ok {
+		fetch = e.clientKeyFetcher(ctx, job)
+		c.fetchers[job.project.ID] = fetch
+	}
+	return fetch
+}
+
+// collectKeyStats emit the most recent bucket of event counts for each of the
+// project's client keys.  Projects with more than maxKeysPerProject keys are skipped
+// to bound cardinality.
+func (e *Exporter) collectKeyStats(ctx context.Context, ch chan<- prometheus.Metric, job *projectFetchJob, clientKeys func() ([]clientKey, error), baseLabels []string, since, until time.Time) {
+	keys, err := clientKeys()
+	if err != nil {
+		return
+	}
+	if e.maxKeysPerProject > 0 && len(keys) > e.maxKeysPerProject {
+		log.Debugf("skipping key stats for project %s; it has %d keys, more than the limit of %d", *job.project.Slug, len(keys), e.maxKeysPerProject)
+		return
+	}
+
+	query := url.Values{}
+	query.Add("since", strconv.FormatInt(since.Unix(), 10))
+	query.Add("until", strconv.FormatInt(until.Unix(), 10))
+	query.Add("resolution", e.statResolution)
+	for _, key := range keys {
+		var stats []keyStat
+		page := sentry.Page{URL: fmt.Sprintf("projects/%s/%s/keys/%s/stats/?%s", *job.organization.Slug, *job.project.Slug, key.ID, query.Encode())}
+		client, cancel := e.clientWithTimeout(ctx, e.statsTimeout)
+		start := time.Now()
+		_, err := client.GetPage(page, &stats)
+		e.observeRequest("get_page", start)
+		cancel()
+		if e.countAPIError("get_page", err) != nil {
+			projectLog(&job.organization, &job.project).WithField("key", key.ID).WithField("operation", "get_page").WithField("error", err).Warn("failed fetching key stats")
+			continue
+		}
+		if len(stats) == 0 {
+			projectLog(&job.organization, &job.project).WithField("key", key.ID).Warn("requested key stats returned no results")
+			continue
+		}
+		lastStat := stats[len(stats)-1]
+		keyLabels := e.labelValues(append(append([]string{}, baseLabels...), key.ID, key.Label)...)
+		for eventType, value := range map[string]float64{
+			"accepted": lastStat.Accepted,
+			"filtered": lastStat.Filtered,
+			"dropped":  lastStat.Dropped,
+		} {
+			labels := append(append([]string{}, keyLabels...), eventType)
+			ch <- prometheus.NewMetricWithTimestamp(
+				time.Unix(int64(lastStat.Timestamp), 0),
+				prometheus.MustNewConstMetric(
+					e.keyStatDesc,
+					prometheus.GaugeValue,
+					value,
+					labels...,
+				),
+			)
+		}
+	}
+}
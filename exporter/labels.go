@@ -0,0 +1,60 @@
+package exporter
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// truncatedSuffixLength is the rune length of the suffix truncateLabelValue
+// appends: an ellipsis followed by 8 hex digits of hash.
+const truncatedSuffixLength = 9
+
+// truncateLabelValue shortens value to maxLength runes if it's longer.  The tail
+// is replaced with a hash of the full value so that long values sharing a prefix
+// still produce distinct series.
+func truncateLabelValue(value string, maxLength int) string {
+	if maxLength <= 0 || utf8.RuneCountInString(value) <= maxLength {
+		return value
+	}
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return fmt.Sprintf("%s…%08x", string([]rune(value)[:maxLength-truncatedSuffixLength]), h.Sum32())
+}
+
+// sanitizeLabelValue replaces invalid UTF-8 and control characters in value with
+// the unicode replacement character, reporting if it had to.  Prometheus panics on
+// invalid UTF-8 label values, which would take out the entire scrape.  A
+// replacement character that's actually in value is left alone, so values that
+// were already sanitized come back unchanged.
+func sanitizeLabelValue(value string) (string, bool) {
+	if utf8.ValidString(value) && strings.IndexFunc(value, unicode.IsControl) == -1 {
+		return value, false
+	}
+	var b strings.Builder
+	for len(value) > 0 {
+		r, width := utf8.DecodeRuneInString(value)
+		if (r == utf8.RuneError && width == 1) || unicode.IsControl(r) {
+			r = utf8.RuneError
+		}
+		b.WriteRune(r)
+		value = value[width:]
+	}
+	return b.String(), true
+}
+
+// labelValues returns a copy of values with the exporter's label restrictions
+// applied.  Every label value handed to prometheus should pass through this.
+func (e *Exporter) labelValues(values ...string) []string {
+	restricted := make([]string, len(values))
+	for i, value := range values {
+		var sanitized bool
+		if value, sanitized = sanitizeLabelValue(value); sanitized {
+			e.sanitizedLabels.Inc()
+		}
+		restricted[i] = truncateLabelValue(value, e.maxLabelLength)
+	}
+	return restricted
+}
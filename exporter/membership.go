@@ -0,0 +1,47 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/atlassian/go-sentry-api"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// collectMembers emit the member count of the organization and each of its
+// teams.  go-sentry-api decodes neither, so each is counted from its member
+// listing.
+func (e *Exporter) collectMembers(ctx context.Context, ch chan<- prometheus.Metric, org *sentry.Organization) {
+	count, err := e.countListing(ctx, fmt.Sprintf("organizations/%s/members/?per_page=%d", *org.Slug, maxPageSize))
+	if err != nil {
+		log.WithField("organization", *org.Slug).WithField("operation", "get_page").WithField("error", err).Warn("failed counting organization members")
+	} else {
+		ch <- prometheus.MustNewConstMetric(
+			e.orgMembersDesc,
+			prometheus.GaugeValue,
+			float64(count),
+			e.labelValues(*org.Slug, *org.ID)...,
+		)
+	}
+	if org.Teams == nil {
+		return
+	}
+	for _, team := range *org.Teams {
+		// enumeration already counted teams missing these.
+		if team.Slug == nil || team.ID == nil {
+			continue
+		}
+		count, err := e.countListing(ctx, fmt.Sprintf("teams/%s/%s/members/?per_page=%d", *org.Slug, *team.Slug, maxPageSize))
+		if err != nil {
+			log.WithField("organization", *org.Slug).WithField("team", *team.Slug).WithField("operation", "get_page").WithField("error", err).Warn("failed counting team members")
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.teamMembersDesc,
+			prometheus.GaugeValue,
+			float64(count),
+			e.labelValues(*org.Slug, *org.ID, *team.Slug, *team.ID)...,
+		)
+	}
+}
@@ -0,0 +1,565 @@
+package exporter
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/atlassian/go-sentry-api"
+	"github.com/prometheus/common/model"
+	"golang.org/x/time/rate"
+)
+
+// Option configures optional behavior of an Exporter; pass them to NewExporter
+type Option func(*Exporter) error
+
+// WithMaxLabelLength truncate label values longer than maxLength runes; 0 disables truncation
+func WithMaxLabelLength(maxLength int) Option {
+	return func(e *Exporter) error {
+		if maxLength < 0 || (maxLength > 0 && maxLength <= truncatedSuffixLength) {
+			return fmt.Errorf("max label length must be 0 (unlimited) or greater than %d, got %d", truncatedSuffixLength, maxLength)
+		}
+		e.maxLabelLength = maxLength
+		return nil
+	}
+}
+
+// How projects that aren't assigned to any team are reported.  A project is only
+// team-less if no team lists it; a project in any team is reported under its
+// teams alone.
+const (
+	// TeamlessProjectsPlaceholder report them with team_slug set to TeamlessPlaceholder
+	TeamlessProjectsPlaceholder = "placeholder"
+	// TeamlessProjectsEmpty report them with empty team labels
+	TeamlessProjectsEmpty = "empty"
+	// TeamlessProjectsDrop don't collect them at all
+	TeamlessProjectsDrop = "drop"
+)
+
+// TeamlessPlaceholder team_slug value used for TeamlessProjectsPlaceholder
+const TeamlessPlaceholder = "__none__"
+
+// WithTeamlessProjects set how projects without a team are reported; one of
+// the TeamlessProjects* constants
+func WithTeamlessProjects(mode string) Option {
+	return func(e *Exporter) error {
+		switch mode {
+		case TeamlessProjectsPlaceholder, TeamlessProjectsEmpty, TeamlessProjectsDrop:
+			e.teamlessProjects = mode
+			return nil
+		}
+		return fmt.Errorf("invalid teamless projects mode %q; must be one of %s, %s, or %s",
+			mode, TeamlessProjectsPlaceholder, TeamlessProjectsEmpty, TeamlessProjectsDrop)
+	}
+}
+
+// WithRetryQueuePasses retry stat fetches that failed during a scrape up to passes
+// times once the rest of the scrape has finished; 0 disables retries
+func WithRetryQueuePasses(passes int) Option {
+	return func(e *Exporter) error {
+		if passes < 0 {
+			return fmt.Errorf("retry queue passes must be >= 0, got %d", passes)
+		}
+		e.retryQueuePasses = passes
+		return nil
+	}
+}
+
+// WithRetries retry organization and stat requests failing with a 5xx or a
+// timeout up to retries times, waiting baseDelay before the first retry and
+// doubling it for each one after.  0 retries disables this.
+func WithRetries(retries int, baseDelay time.Duration) Option {
+	return func(e *Exporter) error {
+		if retries < 0 {
+			return fmt.Errorf("retries must be >= 0, got %d", retries)
+		}
+		if baseDelay < 0 {
+			return fmt.Errorf("retry base delay must be >= 0, got %s", baseDelay)
+		}
+		e.retryMax, e.retryBaseDelay = retries, baseDelay
+		return nil
+	}
+}
+
+// WithRetryBackoff cap the delay between WithRetries retries at maxDelay, and
+// shorten each delay by a random fraction of up to jitter so exporters failing
+// together don't retry in lockstep.  A maxDelay of 0 leaves the delay uncapped.
+func WithRetryBackoff(maxDelay time.Duration, jitter float64) Option {
+	return func(e *Exporter) error {
+		if maxDelay < 0 {
+			return fmt.Errorf("retry max delay must be >= 0, got %s", maxDelay)
+		}
+		if jitter < 0 || jitter > 1 {
+			return fmt.Errorf("retry jitter must be between 0 and 1, got %v", jitter)
+		}
+		e.retryMaxDelay, e.retryJitter = maxDelay, jitter
+		return nil
+	}
+}
+
+// WithOwnership add an owner label to project metrics, taken from the project's
+// ownership rules or its first team.  This costs an extra, cached, request per project.
+func WithOwnership(enabled bool) Option {
+	return func(e *Exporter) error {
+		e.collectOwnership = enabled
+		return nil
+	}
+}
+
+// WithMinScrapeInterval don't query sentry more often than interval; scrapes arriving
+// sooner are served the previous collection's results.  0 disables the limit.
+func WithMinScrapeInterval(interval time.Duration) Option {
+	return func(e *Exporter) error {
+		if interval < 0 {
+			return fmt.Errorf("min scrape interval must be >= 0, got %s", interval)
+		}
+		e.minScrapeInterval = interval
+		return nil
+	}
+}
+
+// WithScrapeTimeout bound each collection to timeout; once it passes, no further
+// fetches are started, the scrape serves what it collected, and sentry_up reports
+// failure.  0 disables the bound.
+func WithScrapeTimeout(timeout time.Duration) Option {
+	return func(e *Exporter) error {
+		if timeout < 0 {
+			return fmt.Errorf("scrape timeout must be >= 0, got %s", timeout)
+		}
+		e.scrapeTimeout = timeout
+		return nil
+	}
+}
+
+// WithTopologyCache reuse the enumerated organizations, teams, and projects for
+// ttl rather than walking them every scrape; stats are still pulled every scrape.
+// Only complete enumerations are cached.  0 disables the cache.
+func WithTopologyCache(ttl time.Duration) Option {
+	return func(e *Exporter) error {
+		if ttl < 0 {
+			return fmt.Errorf("topology cache ttl must be >= 0, got %s", ttl)
+		}
+		e.topologyCacheTTL = ttl
+		return nil
+	}
+}
+
+// WithKeyStats emit event counts per client key (DSN) of each project, skipping
+// projects with more than maxKeysPerProject keys (0 for no limit).  This costs a
+// request per project, shared with WithProjectState and WithRateLimits, plus one
+// per key.
+func WithKeyStats(enabled bool, maxKeysPerProject int) Option {
+	return func(e *Exporter) error {
+		if maxKeysPerProject < 0 {
+			return fmt.Errorf("max keys per project must be >= 0, got %d", maxKeysPerProject)
+		}
+		e.collectKeys = enabled
+		e.maxKeysPerProject = maxKeysPerProject
+		return nil
+	}
+}
+
+// WithAlignedBuckets end each stat query on a bucket boundary of the stat resolution
+// rather than at the current time, so consecutive scrapes query the same buckets
+func WithAlignedBuckets(enabled bool) Option {
+	return func(e *Exporter) error {
+		e.alignBuckets = enabled
+		return nil
+	}
+}
+
+// WithOrgConcurrency pull up to concurrency organizations' details at once; this is
+// independent of the stat fetch concurrency
+func WithOrgConcurrency(concurrency int) Option {
+	return func(e *Exporter) error {
+		if concurrency <= 0 {
+			return fmt.Errorf("org concurrency must be >= 1, got %d", concurrency)
+		}
+		e.maxOrgConcurrency = uint32(concurrency)
+		return nil
+	}
+}
+
+// WithSharedConcurrency cap stat fetches in flight along with every other
+// exporter given shared, on top of this exporter's own stat fetch concurrency.
+// nil leaves only the exporter's own.
+func WithSharedConcurrency(shared *SharedConcurrency) Option {
+	return func(e *Exporter) error {
+		e.sharedConcurrency = shared
+		return nil
+	}
+}
+
+// WithStatConcurrency fetch up to concurrency of a project's stat types at once,
+// borrowing idle fetch workers' share of the stat fetch concurrency; it's never
+// exceeded in total
+func WithStatConcurrency(concurrency int) Option {
+	return func(e *Exporter) error {
+		if concurrency <= 0 {
+			return fmt.Errorf("stat concurrency must be >= 1, got %d", concurrency)
+		}
+		e.statConcurrency = concurrency
+		return nil
+	}
+}
+
+// WithPageSize request pages of size entries when paginating sentry listings; 0
+// uses sentry's default
+func WithPageSize(size int) Option {
+	return func(e *Exporter) error {
+		if size < 0 || size > maxPageSize {
+			return fmt.Errorf("page size must be between 0 (sentry's default) and %d, got %d", maxPageSize, size)
+		}
+		e.pageSize = size
+		return nil
+	}
+}
+
+// WithSourceLabel add a source label to project stats; "live" when freshly
+// collected, "cache" when served from a previous collection
+func WithSourceLabel(enabled bool) Option {
+	return func(e *Exporter) error {
+		e.sourceLabel = enabled
+		return nil
+	}
+}
+
+// WithTimeouts set the timeouts for enumeration (organization, team, and project
+// listing) and stat requests.  0 leaves that timeout as the sentry client's.
+func WithTimeouts(enumeration, stats time.Duration) Option {
+	return func(e *Exporter) error {
+		if enumeration < 0 || stats < 0 {
+			return fmt.Errorf("timeouts must be >= 0, got %s and %s", enumeration, stats)
+		}
+		if enumeration != 0 {
+			e.enumTimeout = enumeration
+		}
+		if stats != 0 {
+			e.statsTimeout = stats
+		}
+		return nil
+	}
+}
+
+// WithGroupByTag add a label named after tag to project metrics, holding the most
+// common value of that tag across the project's events.  This costs an extra,
+// cached, request per project.
+func WithGroupByTag(tag string) Option {
+	return func(e *Exporter) error {
+		if tag == "" {
+			return nil
+		}
+		name := tagLabelName(tag)
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("group by tag %q makes the label name %q, which prometheus doesn't allow; label names may not start with a digit, and those starting with __ are reserved", tag, name)
+		}
+		for _, label := range append(append([]string{}, projectLabelNames...), "type", "dimension", "platform", "owner", "shard", "source") {
+			if name == label {
+				return fmt.Errorf("group by tag %q conflicts with the %s label", tag, label)
+			}
+		}
+		e.groupByTag = tag
+		return nil
+	}
+}
+
+// WithRatios enable the precomputed per project rejection ratio
+func WithRatios(enabled bool) Option {
+	return func(e *Exporter) error {
+		e.emitRatios = enabled
+		return nil
+	}
+}
+
+// WithStatBuckets enable reporting how many buckets each project stat request
+// returned, to spot sparse or truncated responses
+func WithStatBuckets(enabled bool) Option {
+	return func(e *Exporter) error {
+		e.emitStatBuckets = enabled
+		return nil
+	}
+}
+
+// WithSavedQueries run the given saved discover queries each scrape, exporting the
+// number of rows each results in.  Queries are given as <organization slug>:<query id>.
+func WithSavedQueries(queries []string) Option {
+	return func(e *Exporter) error {
+		for _, query := range queries {
+			parts := strings.SplitN(query, ":", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return fmt.Errorf("saved query %q isn't of the form <organization slug>:<query id>", query)
+			}
+			e.savedQueries = append(e.savedQueries, savedQueryRef{organization: parts[0], id: parts[1]})
+		}
+		return nil
+	}
+}
+
+// WithRateLimit bound the requests per second sent to sentry across all workers, 0
+// for no limit.  Requests are spaced out rather than allowed to burst.
+func WithRateLimit(rps float64) Option {
+	return func(e *Exporter) error {
+		if rps < 0 {
+			return fmt.Errorf("rate limit must be >= 0, got %v", rps)
+		}
+		if rps > 0 {
+			e.limiter = rate.NewLimiter(rate.Limit(rps), 1)
+		}
+		return nil
+	}
+}
+
+// WithStatTypes restrict the project stat types collected to types; see StatTypes
+// for what's available.
+func WithStatTypes(types []string) Option {
+	return func(e *Exporter) error {
+		e.projectStats = make(map[string]sentry.StatQuery, len(types))
+		for _, statType := range types {
+			query, ok := collectedProjectStats[statType]
+			if !ok {
+				return fmt.Errorf("unknown stat type %q", statType)
+			}
+			e.projectStats[statType] = query
+		}
+		return nil
+	}
+}
+
+// WithDistribution emit a histogram of received event counts across projects
+func WithDistribution(enabled bool) Option {
+	return func(e *Exporter) error {
+		e.emitDistribution = enabled
+		return nil
+	}
+}
+
+// WithProjectSeries controls whether the per project event count series are
+// emitted; disabling them is mainly useful alongside WithDistribution.
+func WithProjectSeries(enabled bool) Option {
+	return func(e *Exporter) error {
+		e.projectSeries = enabled
+		return nil
+	}
+}
+
+// WithProjectState emit whether each project is accepting events; this costs a
+// request per project, shared with WithKeyStats and WithRateLimits.
+func WithProjectState(enabled bool) Option {
+	return func(e *Exporter) error {
+		e.collectProjectStates = enabled
+		return nil
+	}
+}
+
+// WithIssueCounts emit the number of unresolved, resolved, and ignored issues of
+// each project.  Sentry has no issue totals, so this pages through every issue of
+// every project; expect it to cost more requests than everything else combined.
+func WithIssueCounts(enabled bool) Option {
+	return func(e *Exporter) error {
+		e.collectIssues = enabled
+		return nil
+	}
+}
+
+// WithRateLimits emit the configured rate limit of each client key that has one.
+// Costs a request per project, shared with WithKeyStats and WithProjectState.
+func WithRateLimits(enabled bool) Option {
+	return func(e *Exporter) error {
+		e.collectRateLimits = enabled
+		return nil
+	}
+}
+
+// WithReleases emit the maxReleasesPerProject most recent releases of each
+// project, along with the issues first seen in each.  This costs a request per
+// project.
+func WithReleases(enabled bool, maxReleasesPerProject int) Option {
+	return func(e *Exporter) error {
+		if maxReleasesPerProject < 1 || maxReleasesPerProject > maxPageSize {
+			return fmt.Errorf("max releases per project must be in [1, %d], got %d", maxPageSize, maxReleasesPerProject)
+		}
+		e.collectReleases = enabled
+		e.maxReleasesPerProject = maxReleasesPerProject
+		return nil
+	}
+}
+
+// WithMembership emit the member count of every organization and team.  Costs a
+// request per organization and team, plus one per further page of members.
+func WithMembership(enabled bool) Option {
+	return func(e *Exporter) error {
+		e.collectMembership = enabled
+		return nil
+	}
+}
+
+// WithBackfillDay collect the daily stat bucket for the given UTC day instead of
+// the most recent bucket
+func WithBackfillDay(day time.Time) Option {
+	return func(e *Exporter) error {
+		day = day.UTC().Truncate(24 * time.Hour)
+		if !day.Before(time.Now().UTC().Truncate(24 * time.Hour)) {
+			return fmt.Errorf("backfill day %s hasn't finished yet", day.Format("2006-01-02"))
+		}
+		e.statResolution = "1d"
+		e.statResolutionDuration = 24 * time.Hour
+		// backfilled samples need the bucket's timestamp.
+		e.aggregateMode = AggregateLast
+		// sentry includes the bucket holding until, so stop just short of the
+		// next day.
+		e.backfillUntil = day.Add(24*time.Hour - time.Second)
+		return nil
+	}
+}
+
+// WithSplitByType emit a metric per stat type, such as sentry_project_received_count,
+// rather than a single metric with a type label
+func WithSplitByType(enabled bool) Option {
+	return func(e *Exporter) error {
+		e.splitByType = enabled
+		return nil
+	}
+}
+
+// What sentry_up reports when listing organizations fails
+const (
+	// UpFullyFunctional report down on any failure
+	UpFullyFunctional = "fully-functional"
+	// UpReachability report up if sentry answered, even if it rejected the auth
+	// token; sentry_auth_ok reports the token separately either way
+	UpReachability = "reachability"
+)
+
+// WithUpSemantics set how sentry_up treats auth failures; see UpFullyFunctional
+// and UpReachability
+func WithUpSemantics(mode string) Option {
+	return func(e *Exporter) error {
+		switch mode {
+		case UpFullyFunctional, UpReachability:
+			e.upSemantics = mode
+			return nil
+		}
+		return fmt.Errorf("invalid up semantics %q; must be %s or %s", mode, UpFullyFunctional, UpReachability)
+	}
+}
+
+// WithRequestBudget cap the requests a collection sends to sentry; once used up,
+// the rest of the collection's fetches fail and it reports what it got.  0 for
+// no limit.
+func WithRequestBudget(requests int) Option {
+	return func(e *Exporter) error {
+		if requests < 0 {
+			return fmt.Errorf("request budget must be >= 0, got %d", requests)
+		}
+		e.requestBudget = int64(requests)
+		return nil
+	}
+}
+
+// WithMaxProjects fetch stats for at most projects projects per collection,
+// skipping the rest; 0 for no limit
+func WithMaxProjects(projects int) Option {
+	return func(e *Exporter) error {
+		if projects < 0 {
+			return fmt.Errorf("max projects must be >= 0, got %d", projects)
+		}
+		e.maxProjects = projects
+		return nil
+	}
+}
+
+// WithSharding label project metrics with which of shards shards the project
+// falls in, by a hash of its ID; shards of 0 disables this.  If only is >= 0,
+// projects outside that shard are skipped entirely, so several exporters can
+// split an install between them.
+func WithSharding(shards, only int) Option {
+	return func(e *Exporter) error {
+		if shards < 0 {
+			return fmt.Errorf("shard count must be >= 0, got %d", shards)
+		}
+		if only >= 0 && only >= shards {
+			return fmt.Errorf("shard %d needs a shard count greater than it, got %d", only, shards)
+		}
+		e.shardCount, e.shard = shards, only
+		return nil
+	}
+}
+
+// WithStoredStats also collect the count of events sentry stored, after sampling
+// and quotas, adding a dimension label to tell it from the received count
+func WithStoredStats(enabled bool) Option {
+	return func(e *Exporter) error {
+		e.collectStored = enabled
+		return nil
+	}
+}
+
+// WithStatResolution set the stat bucket size requested from sentry, one of 10s,
+// 1h, or 1d, and how far back from now stats are requested.  WithAggregateMode
+// decides what's exported from the window.
+func WithStatResolution(resolution string, window time.Duration) Option {
+	return func(e *Exporter) error {
+		if _, ok := statResolutions[resolution]; !ok {
+			return fmt.Errorf("invalid stat resolution %q; must be one of 10s, 1h, or 1d", resolution)
+		}
+		if window <= 0 {
+			return fmt.Errorf("stat window must be > 0, got %s", window)
+		}
+		e.statResolution, e.statResolutionDuration = resolution, window
+		return nil
+	}
+}
+
+// How the stat buckets in the window are reduced to the exported value
+const (
+	// AggregateLast export the newest bucket, timestamped with its start
+	AggregateLast = "last"
+	// AggregateSum export the sum of every bucket in the window, without a
+	// timestamp, as the sentry_project_events_window gauge
+	AggregateSum = "sum"
+)
+
+// WithAggregateMode set how stat buckets are reduced; see AggregateLast and
+// AggregateSum
+func WithAggregateMode(mode string) Option {
+	return func(e *Exporter) error {
+		switch mode {
+		case AggregateLast, AggregateSum:
+			e.aggregateMode = mode
+			return nil
+		}
+		return fmt.Errorf("invalid aggregate mode %q; must be %s or %s", mode, AggregateLast, AggregateSum)
+	}
+}
+
+// WithOrganizationFilter only collect organizations whose slug is in include, if
+// it's non empty, and skip those in exclude
+func WithOrganizationFilter(include, exclude []string) Option {
+	return func(e *Exporter) error {
+		e.includeOrganizations = make(map[string]bool, len(include))
+		for _, slug := range include {
+			e.includeOrganizations[slug] = true
+		}
+		e.excludeOrganizations = make(map[string]bool, len(exclude))
+		for _, slug := range exclude {
+			e.excludeOrganizations[slug] = true
+		}
+		return nil
+	}
+}
+
+// WithProjectFilter only collect projects whose slug matches a path.Match pattern
+// in include, if it's non empty, and skip those matching one in exclude.
+// Skipped projects cost no stat requests.
+func WithProjectFilter(include, exclude []string) Option {
+	return func(e *Exporter) error {
+		for _, pattern := range append(append([]string{}, include...), exclude...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid project pattern %q: %s", pattern, err)
+			}
+		}
+		e.includeProjects, e.excludeProjects = include, exclude
+		return nil
+	}
+}
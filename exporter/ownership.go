@@ -0,0 +1,60 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/atlassian/go-sentry-api"
+)
+
+// ownershipCacheTTL how long a project's derived owner is reused; ownership
+// rules rarely change, and looking them up costs a request per project.
+const ownershipCacheTTL = time.Hour
+
+type projectOwnership struct {
+	Raw string `json:"raw"`
+}
+
+// projectOwner returns the primary owner of the project; the first owner named in
+// its ownership rules, or fallback if there are no rules.
+func (e *Exporter) projectOwner(ctx context.Context, organization *sentry.Organization, project *sentry.Project, fallback string) string {
+	if owner, ok := e.owners.get(project.ID); ok {
+		return owner
+	}
+
+	var ownership projectOwnership
+	page := sentry.Page{URL: fmt.Sprintf("projects/%s/%s/ownership/", *organization.Slug, *project.Slug)}
+	client, cancel := e.clientWithTimeout(ctx, e.enumTimeout)
+	start := time.Now()
+	_, err := client.GetPage(page, &ownership)
+	e.observeRequest("get_page", start)
+	cancel()
+	if e.countAPIError("get_page", err) != nil {
+		projectLog(organization, project).WithField("owner", fallback).WithField("operation", "get_page").WithField("error", err).Warn("failed fetching ownership rules, using the fallback owner")
+		return fallback
+	}
+	owner := firstOwner(ownership.Raw)
+	if owner == "" {
+		owner = fallback
+	}
+	e.owners.set(project.ID, owner)
+	return owner
+}
+
+// firstOwner returns the first owner in sentry ownership rules text, for example
+// "backend" for "path:src/* #backend jane@example.com".  Team owners are returned
+// without their leading '#'.
+func firstOwner(rules string) string {
+	for _, line := range strings.Split(rules, "\n") {
+		fields := strings.Fields(line)
+		// comment lines start with '#', as do team owners, so only the leading
+		// field marks a comment.
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		return strings.TrimPrefix(fields[1], "#")
+	}
+	return ""
+}
@@ -0,0 +1,35 @@
+package exporter
+
+import (
+	"context"
+	"time"
+
+	"github.com/atlassian/go-sentry-api"
+)
+
+// pager fetches a page of a sentry listing, decoding it into out.  It returns
+// the path of the following page, or "" if this was the last one.  Listings go
+// through this rather than go-sentry-api directly so upstream changes to how it
+// paginates only touch the adapter.
+type pager interface {
+	fetchPage(ctx context.Context, path string, out interface{}) (next string, err error)
+}
+
+// clientPager is the pager backed by the exporter's sentry client
+type clientPager struct {
+	exporter *Exporter
+	timeout  time.Duration
+}
+
+func (p *clientPager) fetchPage(ctx context.Context, path string, out interface{}) (string, error) {
+	client, cancel := p.exporter.clientWithTimeout(ctx, p.timeout)
+	defer cancel()
+	link, err := client.GetPage(sentry.Page{URL: path}, out)
+	if err != nil {
+		return "", err
+	}
+	if link == nil || !link.Next.Results {
+		return "", nil
+	}
+	return link.Next.URL, nil
+}
@@ -0,0 +1,30 @@
+package exporter
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// collectKeyRateLimits emit the configured rate limit of each of the project's client
+// keys that has one.  Sentry configures these per key rather than per project.
+func (e *Exporter) collectKeyRateLimits(ch chan<- prometheus.Metric, clientKeys func() ([]clientKey, error), baseLabels []string) {
+	keys, err := clientKeys()
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		if key.RateLimit == nil {
+			continue
+		}
+		labels := e.labelValues(append(append([]string{}, baseLabels...), key.ID, key.Label)...)
+		ch <- prometheus.MustNewConstMetric(
+			e.rateLimitCountDesc,
+			prometheus.GaugeValue,
+			key.RateLimit.Count,
+			labels...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			e.rateLimitWindowDesc,
+			prometheus.GaugeValue,
+			key.RateLimit.Window,
+			labels...,
+		)
+	}
+}
@@ -0,0 +1,53 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/atlassian/go-sentry-api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// projectRelease is the part of a release needed for the release metrics;
+// NewGroups is the number of issues first seen in it.
+type projectRelease struct {
+	Version     string    `json:"version"`
+	DateCreated time.Time `json:"dateCreated"`
+	NewGroups   float64   `json:"newGroups"`
+}
+
+// collectProjectReleases emit an info series and the new issue count for each of the
+// project's most recent releases, up to maxReleasesPerProject of them.  Sentry
+// lists the newest releases first, so only the first page is fetched.
+func (e *Exporter) collectProjectReleases(ctx context.Context, ch chan<- prometheus.Metric, job *projectFetchJob, baseLabels []string) {
+	var releases []projectRelease
+	page := sentry.Page{URL: fmt.Sprintf("projects/%s/%s/releases/?per_page=%d", *job.organization.Slug, *job.project.Slug, e.maxReleasesPerProject)}
+	client, cancel := e.clientWithTimeout(ctx, e.enumTimeout)
+	start := time.Now()
+	_, err := client.GetPage(page, &releases)
+	e.observeRequest("get_page", start)
+	cancel()
+	if e.countAPIError("get_page", err) != nil {
+		projectLog(&job.organization, &job.project).WithField("operation", "get_page").WithField("error", err).Warn("failed fetching releases")
+		return
+	}
+	if len(releases) > e.maxReleasesPerProject {
+		releases = releases[:e.maxReleasesPerProject]
+	}
+	for _, release := range releases {
+		labels := e.labelValues(append(append([]string{}, baseLabels...), release.Version)...)
+		ch <- prometheus.MustNewConstMetric(
+			e.releaseInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			append(append([]string{}, labels...), release.DateCreated.UTC().Format(time.RFC3339))...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			e.releaseNewIssuesDesc,
+			prometheus.GaugeValue,
+			release.NewGroups,
+			labels...,
+		)
+	}
+}
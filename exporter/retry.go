@@ -0,0 +1,57 @@
+package exporter
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/atlassian/go-sentry-api"
+	log "github.com/sirupsen/logrus"
+)
+
+// isTransient returns if err is worth retrying; a 5xx or 429 from sentry, or a
+// timeout.  Anything else, other 4xx's included, would fail the same way again.
+func isTransient(err error) bool {
+	if apiErr, ok := err.(sentry.APIError); ok {
+		return apiErr.StatusCode >= 500 || apiErr.StatusCode == 429
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// retryDelay returns the delay before retry attempt, counting from 1; it's
+// retryBaseDelay doubled for each attempt after the first up to retryMaxDelay,
+// less up to retryJitter of it.
+func (e *Exporter) retryDelay(attempt int) time.Duration {
+	delay := e.retryBaseDelay
+	for i := 1; i < attempt && (e.retryMaxDelay <= 0 || delay < e.retryMaxDelay); i++ {
+		delay *= 2
+	}
+	if e.retryMaxDelay > 0 && delay > e.retryMaxDelay {
+		delay = e.retryMaxDelay
+	}
+	if e.retryJitter > 0 {
+		delay -= time.Duration(float64(delay) * e.retryJitter * rand.Float64())
+	}
+	return delay
+}
+
+// withRetries call fn, retrying up to retryMax times while it fails transiently,
+// waiting retryDelay between attempts; retries stop once ctx is done.
+func (e *Exporter) withRetries(ctx context.Context, operation string, fn func() error) error {
+	err := fn()
+	for attempt := 1; attempt <= e.retryMax && err != nil && isTransient(err); attempt++ {
+		delay := e.retryDelay(attempt)
+		log.Debugf("%s failed, retry %d of %d in %s; err %s", operation, attempt, e.retryMax, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		err = fn()
+	}
+	return err
+}
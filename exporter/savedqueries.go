@@ -0,0 +1,101 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// savedQueryRef identifies a saved discover query; query ID's are only unique
+// within an organization.
+type savedQueryRef struct {
+	organization string
+	id           string
+}
+
+// savedQuery is the subset of a saved discover query needed to run it
+type savedQuery struct {
+	Projects    []int    `json:"projects"`
+	Environment []string `json:"environment"`
+	Fields      []string `json:"fields"`
+	Query       string   `json:"query"`
+	Range       *string  `json:"range"`
+	Start       *string  `json:"start"`
+	End         *string  `json:"end"`
+}
+
+type eventsResult struct {
+	Data []map[string]interface{} `json:"data"`
+}
+
+// eventsPath returns the events query equivalent to running the saved query
+func (q *savedQuery) eventsPath(organization string) string {
+	params := url.Values{}
+	for _, field := range q.Fields {
+		params.Add("field", field)
+	}
+	for _, project := range q.Projects {
+		params.Add("project", strconv.Itoa(project))
+	}
+	for _, environment := range q.Environment {
+		params.Add("environment", environment)
+	}
+	if q.Query != "" {
+		params.Set("query", q.Query)
+	}
+	if q.Start != nil && q.End != nil {
+		params.Set("start", *q.Start)
+		params.Set("end", *q.End)
+	} else if q.Range != nil {
+		params.Set("statsPeriod", *q.Range)
+	}
+	return fmt.Sprintf("organizations/%s/events/?%s", organization, params.Encode())
+}
+
+// runSavedQuery returns the number of rows the saved query results in
+func (e *Exporter) runSavedQuery(ctx context.Context, ref savedQueryRef) (int, error) {
+	var query savedQuery
+	start := time.Now()
+	_, err := e.pager.fetchPage(ctx, fmt.Sprintf("organizations/%s/discover/saved/%s/", ref.organization, ref.id), &query)
+	e.observeRequest("get_page", start)
+	if e.countAPIError("get_page", err) != nil {
+		return 0, err
+	}
+	if len(query.Fields) == 0 {
+		return 0, fmt.Errorf("saved query has no fields")
+	}
+	rows := 0
+	for path := query.eventsPath(ref.organization); path != ""; {
+		var result eventsResult
+		start := time.Now()
+		next, err := e.pager.fetchPage(ctx, path, &result)
+		e.observeRequest("get_page", start)
+		if e.countAPIError("get_page", err) != nil {
+			return 0, err
+		}
+		rows += len(result.Data)
+		path = next
+	}
+	return rows, nil
+}
+
+func (e *Exporter) collectSavedQueries(ctx context.Context, ch chan<- prometheus.Metric) {
+	for _, ref := range e.savedQueries {
+		rows, err := e.runSavedQuery(ctx, ref)
+		if err != nil {
+			log.WithField("organization", ref.organization).WithField("query", ref.id).WithField("error", err).Warn("failed running saved query")
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.savedQueryDesc,
+			prometheus.GaugeValue,
+			float64(rows),
+			e.labelValues(ref.organization, ref.id)...,
+		)
+	}
+}
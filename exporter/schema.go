@@ -0,0 +1,14 @@
+package exporter
+
+import log "github.com/sirupsen/logrus"
+
+// anomalous record a schema anomaly for field when missing is true; for fields
+// sentry should always return but go-sentry-api leaves nil if it doesn't.
+// Returns missing, so callers can skip the entity.
+func (e *Exporter) anomalous(field string, missing bool, context string) bool {
+	if missing {
+		log.Warnf("sentry returned no %s for %s, skipping it", field, context)
+		e.schemaAnomalies.WithLabelValues(field).Inc()
+	}
+	return missing
+}
@@ -0,0 +1,54 @@
+package exporter
+
+import "sync/atomic"
+
+// SharedConcurrency caps the stat fetches in flight across every exporter given
+// it with WithSharedConcurrency, such as those of several sentry instances
+// scraped together.
+type SharedConcurrency struct {
+	slots chan struct{}
+}
+
+// NewSharedConcurrency returns a cap of limit stat fetches at once
+func NewSharedConcurrency(limit int) *SharedConcurrency {
+	return &SharedConcurrency{slots: make(chan struct{}, limit)}
+}
+
+// acquireShared take one of the shared concurrency slots, waiting for one if
+// block is set; it returns if it got one.  Without shared concurrency there's
+// nothing to take, and it always succeeds.
+func (e *Exporter) acquireShared(block bool) bool {
+	if e.sharedConcurrency == nil {
+		return true
+	}
+	if block {
+		e.sharedConcurrency.slots <- struct{}{}
+	} else {
+		select {
+		case e.sharedConcurrency.slots <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	storeMax(&e.sharedPeak, atomic.AddInt64(&e.sharedHeld, 1))
+	return true
+}
+
+// releaseShared give back a slot taken by acquireShared
+func (e *Exporter) releaseShared() {
+	if e.sharedConcurrency == nil {
+		return
+	}
+	atomic.AddInt64(&e.sharedHeld, -1)
+	<-e.sharedConcurrency.slots
+}
+
+// storeMax raise the value at addr to value if it's lower
+func storeMax(addr *int64, value int64) {
+	for {
+		current := atomic.LoadInt64(addr)
+		if value <= current || atomic.CompareAndSwapInt64(addr, current, value) {
+			return
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package exporter
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// collectProjectState emit whether the project accepts events; that requires
+// the project be active, and have at least one enabled client key.
+func (e *Exporter) collectProjectState(ch chan<- prometheus.Metric, job *projectFetchJob, clientKeys func() ([]clientKey, error), baseLabels []string) {
+	enabled := job.project.Status == "" || job.project.Status == "active"
+	if enabled {
+		keys, err := clientKeys()
+		if err != nil {
+			return
+		}
+		enabled = false
+		for _, key := range keys {
+			enabled = enabled || key.IsActive
+		}
+	}
+	var value float64
+	if enabled {
+		value = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.ingestionEnabledDesc,
+		prometheus.GaugeValue,
+		value,
+		e.labelValues(baseLabels...)...,
+	)
+}
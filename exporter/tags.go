@@ -0,0 +1,60 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/atlassian/go-sentry-api"
+)
+
+// groupTagCacheTTL how long a project's group by tag value is reused
+const groupTagCacheTTL = time.Hour
+
+type tagValue struct {
+	Value string  `json:"value"`
+	Count float64 `json:"count"`
+}
+
+var invalidLabelChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// tagLabelName returns the label name used for a group by tag; the tag name with
+// characters prometheus doesn't allow replaced by underscores.
+func tagLabelName(tag string) string {
+	return invalidLabelChars.ReplaceAllString(tag, "_")
+}
+
+// projectTagValue returns the most common value of the group by tag across the
+// project's events, or "" if the project's events don't carry the tag.
+func (e *Exporter) projectTagValue(ctx context.Context, organization *sentry.Organization, project *sentry.Project) string {
+	if value, ok := e.groupTags.get(project.ID); ok {
+		return value
+	}
+
+	var values []tagValue
+	page := sentry.Page{URL: fmt.Sprintf("projects/%s/%s/tags/%s/values/", *organization.Slug, *project.Slug, url.PathEscape(e.groupByTag))}
+	client, cancel := e.clientWithTimeout(ctx, e.enumTimeout)
+	start := time.Now()
+	_, err := client.GetPage(page, &values)
+	e.observeRequest("get_page", start)
+	cancel()
+	if err != nil {
+		if apiErr, ok := err.(sentry.APIError); !ok || apiErr.StatusCode != 404 {
+			e.countAPIError("get_page", err)
+			projectLog(organization, project).WithField("tag", e.groupByTag).WithField("operation", "get_page").WithField("error", err).Warn("failed fetching tag values")
+			return ""
+		}
+		// sentry 404's for tags the project has never seen.
+	}
+	var value string
+	var count float64
+	for _, v := range values {
+		if v.Count > count {
+			value, count = v.Value, v.Count
+		}
+	}
+	e.groupTags.set(project.ID, value)
+	return value
+}
@@ -0,0 +1,85 @@
+package exporter
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultRateLimitPause is how long to pause after a 429 without a usable
+	// Retry-After.
+	defaultRateLimitPause = time.Second
+	// maxRateLimitPause bounds how long any one signal from sentry can pause
+	// requests for.
+	maxRateLimitPause = time.Minute
+)
+
+// throttle pauses every request to sentry once sentry signals it's rate limiting
+// the exporter, either with a 429 or by reporting that lowWater or fewer
+// requests remain in its quota; the latter pauses until the quota resets, rather
+// than spending the rest of it on requests that will be rejected.
+type throttle struct {
+	lowWater    int
+	rateLimited prometheus.Counter
+	lock        sync.Mutex
+	until       time.Time
+}
+
+// wait block until any pause is over, or ctx is done.
+func (t *throttle) wait(ctx context.Context) error {
+	t.lock.Lock()
+	pause := time.Until(t.until)
+	t.lock.Unlock()
+	if pause <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(pause)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// observe pause requests if the response signals rate limiting.
+func (t *throttle) observe(resp *http.Response) {
+	now := time.Now()
+	var until time.Time
+	if resp.StatusCode == http.StatusTooManyRequests {
+		t.rateLimited.Inc()
+		until = now.Add(retryAfter(resp.Header.Get("Retry-After"), now))
+	} else if remaining, err := strconv.Atoi(resp.Header.Get("X-Sentry-Rate-Limit-Remaining")); err == nil && remaining <= t.lowWater {
+		if reset, err := strconv.ParseFloat(resp.Header.Get("X-Sentry-Rate-Limit-Reset"), 64); err == nil {
+			until = time.Unix(int64(reset), 0)
+		}
+	}
+	if max := now.Add(maxRateLimitPause); until.After(max) {
+		until = max
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if until.After(t.until) {
+		log.Debugf("sentry is rate limiting; pausing requests for %s", until.Sub(now))
+		t.until = until
+	}
+}
+
+// retryAfter returns the pause a Retry-After header value asks for, given as
+// either seconds or a date.
+func retryAfter(value string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return defaultRateLimitPause
+}
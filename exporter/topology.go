@@ -0,0 +1,26 @@
+package exporter
+
+import (
+	"time"
+
+	"github.com/atlassian/go-sentry-api"
+)
+
+// topology is the result of a complete organization, team, and project
+// enumeration, kept for reuse by later scrapes.
+type topology struct {
+	jobs          []*projectFetchJob
+	orgDetails    []*sentry.Organization
+	organizations int
+	pages         int
+	expires       time.Time
+}
+
+// cachedTopology returns the cached topology, or nil if there's none or it
+// expired.
+func (e *Exporter) cachedTopology() *topology {
+	if e.topology == nil || time.Now().After(e.topology.expires) {
+		return nil
+	}
+	return e.topology
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sourceHook adds the file and line logging was called from as the source field,
+// as prometheus/common/log did.  logrus' own caller reporting stops inside logrus
+// in the vendored version, so the caller is found here instead.
+type sourceHook struct{}
+
+func (sourceHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (sourceHook) Fire(entry *log.Entry) error {
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !strings.Contains(frame.Function, "github.com/sirupsen/logrus.") {
+			// entries can share Data, so it's copied rather than added to.
+			data := make(log.Fields, len(entry.Data)+1)
+			for key, value := range entry.Data {
+				data[key] = value
+			}
+			data["source"] = fmt.Sprintf("%s:%d", filepath.Base(frame.File), frame.Line)
+			entry.Data = data
+			return nil
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+func init() {
+	log.AddHook(sourceHook{})
+}
+
+// configureLogging apply the log level, and the log format; text or json
+func configureLogging(level, format string) error {
+	parsed, err := log.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid -log.level: %s", err)
+	}
+	log.SetLevel(parsed)
+	switch format {
+	case "text":
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("-log.format must be text or json, got %q", format)
+	}
+	return nil
+}
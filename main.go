@@ -1,42 +1,365 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/atlassian/go-sentry-api"
+	"github.com/ferringb/prometheus_sentry_exporter/config"
 	"github.com/ferringb/prometheus_sentry_exporter/exporter"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/version"
+	log "github.com/sirupsen/logrus"
 )
 
 var (
 	listen            = flag.String("web.listen-address", ":9096", "The host:port to listen on for HTTP requests")
 	metricsPath       = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics")
-	sentryURL         = flag.String("sentry.url", "", "http url for the sentry instance to talk to.  Cal be specified via environment variable SENTRY_URL")
-	sentryAuthToken   = flag.String("sentry.auth-token", "", "bearer token to use for authorization.  Can be specified via environment variable SENTRY_AUTH_TOKEN")
+	tlsCertFile       = flag.String("web.tls-cert-file", "", "certificate to serve HTTPS with; requires -web.tls-key-file")
+	tlsKeyFile        = flag.String("web.tls-key-file", "", "private key for -web.tls-cert-file")
+	authUser          = flag.String("web.basic-auth-user", "", "require HTTP basic auth with this user; requires -web.basic-auth-password-file")
+	authPasswordFile  = flag.String("web.basic-auth-password-file", "", "file holding the password for -web.basic-auth-user")
+	shutdownGrace     = flag.Duration("web.shutdown-grace-period", 30*time.Second, "on SIGTERM or SIGINT, how long to wait for in flight scrapes to finish before exiting")
+	probeCacheTTL     = flag.Duration("web.probe-cache-ttl", 0, "serve /probe requests for the same target and org from the first one's result for this long, so bursts of identical probes cost a single collection.  0 disables the cache")
+	enableProbe       = flag.Bool("web.enable-probe", false, "serve /probe?target=<sentry url>&org=<slug>, collecting the target on request.  Only -sentry.url and -web.probe-targets targets are accepted")
+	probeTargets      = flag.String("web.probe-targets", "", "comma separated sentry urls /probe may collect besides the -sentry.url ones, authenticating with the first -sentry.auth-token")
 	sentryTimeout     = flag.Duration("sentry.timeout", time.Second*10, "http timeouts to enforce for sentry requests")
-	sentryConcurrency = flag.Int("sentry.concurrency", 40, "level of concurrent stats requests to allow against the given sentry")
+	enumTimeout       = flag.Duration("sentry.timeout.enum", 0, "timeout for organization, team, and project listing requests; defaults to -sentry.timeout")
+	statsTimeout      = flag.Duration("sentry.timeout.stats", 0, "timeout for stat requests; defaults to -sentry.timeout")
+	sentryConcurrency = flag.Int("sentry.fetch-concurrency", 40, "level of concurrent stats requests to allow against the given sentry")
+	globalConcurrency = flag.Int("sentry.global-concurrency", 0, "most stats requests to allow at once across every -sentry.url, on top of each one's -sentry.fetch-concurrency; sentry_exporter_effective_concurrency reports each instance's share.  0 disables the shared cap")
+	namespace         = flag.String("metrics.namespace", "sentry", "prefix of every exported metric name, sentry_up becoming <namespace>_up")
+	maxLabelLength    = flag.Int("metrics.max-label-length", 0, "truncate label values longer than this, replacing the tail with a short hash to keep them unique.  0 disables truncation")
+	scrapeTimeout     = flag.Duration("sentry.scrape-timeout", 0, "most time a scrape may spend collecting from sentry; past it no further requests are started, the scrape serves what it collected, and sentry_up is 0.  0 for no limit")
+	topologyCacheTTL  = flag.Duration("sentry.topology-cache-ttl", 0, "reuse the enumerated organizations, teams, and projects for this long instead of walking them every scrape; stats are still pulled every scrape.  0 disables the cache")
+	minScrapeInterval = flag.Duration("sentry.min-scrape-interval", 0, "never query sentry more often than this; scrapes arriving sooner are served the previous results.  0 disables the limit")
+	retryMax          = flag.Int("sentry.retry-max", 0, "most times to retry an organization or stat request failing with a 5xx or timeout, backing off exponentially.  0 disables retries")
+	retryBaseDelay    = flag.Duration("sentry.retry-base-delay", 500*time.Millisecond, "delay before the first -sentry.retry-max retry, doubling for each one after up to -sentry.retry-max-delay")
+	retryMaxDelay     = flag.Duration("sentry.retry-max-delay", 30*time.Second, "longest delay between -sentry.retry-max retries.  0 leaves it uncapped")
+	retryJitter       = flag.Float64("sentry.retry-jitter", 0, "randomly shorten each -sentry.retry-max retry delay by up to this fraction of it, between 0 and 1.  0 disables jitter")
+	degradedThreshold = flag.Float64("sentry.degraded-threshold", 0, "report /ready as degraded, still answering 200, while the last scrape fetched less than this fraction of project stats, between 0 and 1.  0 disables it")
+	retryQueuePasses  = flag.Int("sentry.retry-queue-passes", 0, "number of times stat fetches that failed are retried at the end of a scrape.  0 disables retries")
+	collectOwnership  = flag.Bool("sentry.collect-ownership", false, "add an owner label to project metrics, derived from the project's ownership rules or else its first team.  Costs an extra request per project, cached for an hour")
+	collectKeys       = flag.Bool("sentry.collect-keys", false, "collect event counts per client key (DSN) of each project.  Costs a request per project, shared with -sentry.collect-project-state and -sentry.collect-rate-limits, plus one per key")
+	maxKeysPerProject = flag.Int("sentry.max-keys-per-project", 10, "skip key stats for projects with more client keys than this, to bound cardinality.  0 for no limit")
+	alignBuckets      = flag.Bool("sentry.align-buckets", false, "end stat queries on a UTC aligned bucket boundary rather than the current time, so consecutive scrapes query the same buckets")
+	sourceLabel       = flag.Bool("metrics.source-label", false, "add a source label to project stats; live when freshly collected, cache when served from a previous collection")
+	groupByTag        = flag.String("sentry.group-by-tag", "", "add a label named after this event tag to project metrics, holding the tag's most common value for the project.  Costs an extra request per project, cached for an hour")
+	emitRatios        = flag.Bool("sentry.emit-ratios", false, "emit sentry_project_rejection_ratio, rejected over received events for each project")
+	emitStatBuckets   = flag.Bool("sentry.emit-stat-buckets", false, "emit sentry_project_stat_buckets, the number of buckets sentry returned for each project and stat type; fewer than -sentry.stat-window over -sentry.stat-resolution suggests clock skew or truncated data")
+	savedQueries      = flag.String("sentry.saved-queries", "", "comma separated saved discover queries to run each scrape, as <organization slug>:<query id>; exports the number of result rows of each")
+	rps               = flag.Float64("sentry.rps", 0, "maximum requests per second to send to sentry, 0 for no limit")
+	statTypes         = flag.String("sentry.stat-types", strings.Join(exporter.DefaultStatTypes(), ","), "comma separated project stat types to collect, out of "+strings.Join(exporter.StatTypes(), ", "))
+	tlsServerName     = flag.String("sentry.tls-server-name", "", "server name to verify sentry's certificate against and send via SNI, instead of the host in -sentry.url")
+	caFile            = flag.String("sentry.ca-file", "", "PEM file of CA certificates to verify sentry's certificate against, instead of the system's")
+	insecureTLS       = flag.Bool("sentry.insecure-skip-verify", false, "don't verify sentry's certificate at all; for development only")
+	proxyURL          = flag.String("sentry.proxy-url", "", "http, https, or socks5 proxy to reach sentry through, credentials given as user:password@ in the url; defaults to the HTTPS_PROXY and HTTP_PROXY environment variables")
+	emitDistribution  = flag.Bool("sentry.emit-distribution", false, "emit sentry_project_events_distribution, a histogram of received events across projects")
+	projectSeries     = flag.Bool("sentry.project-series", true, "emit per project event count series; disable to save cardinality when using -sentry.emit-distribution")
+	projectState      = flag.Bool("sentry.collect-project-state", false, "emit sentry_project_ingestion_enabled for each project.  Costs an extra request per project, shared with -sentry.collect-keys and -sentry.collect-rate-limits")
+	collectIssues     = flag.Bool("sentry.collect-issues", false, "emit sentry_project_issues, the number of unresolved, resolved, and ignored issues of each project.  Pages through every issue of every project, so it's by far the most expensive collector")
+	collectRateLimits = flag.Bool("sentry.collect-rate-limits", false, "emit sentry_project_rate_limit_count and sentry_project_rate_limit_window_seconds for each client key (DSN) with a rate limit configured.  Costs an extra request per project, shared with -sentry.collect-keys and -sentry.collect-project-state")
+	collectReleases   = flag.Bool("sentry.collect-releases", false, "emit sentry_release_info and sentry_release_new_issues for the most recent releases of each project.  Costs an extra request per project")
+	maxReleases       = flag.Int("sentry.max-releases-per-project", 5, "number of most recent releases -sentry.collect-releases reports per project, up to 100")
+	collectMembership = flag.Bool("sentry.collect-membership", false, "emit sentry_organization_members and sentry_team_members.  Costs a request per organization and team")
+	backfillDate      = flag.String("sentry.backfill-date", "", "one shot mode; collect the daily totals for this UTC day (YYYY-MM-DD), write them as OpenMetrics for promtool tsdb create-blocks-from openmetrics, and exit")
+	backfillOutput    = flag.String("sentry.backfill-output", "-", "file to write -sentry.backfill-date metrics to, - for stdout")
+	dryRunMode        = flag.Bool("dry-run", false, "enumerate the organizations, teams, and projects that would be collected once filters apply, print them as organization/team/project slugs, and exit without serving")
+	splitByType       = flag.Bool("metrics.split-by-type", false, "emit a metric per stat type, such as sentry_project_received_count, instead of sentry_project_events_count with a type label")
+	upSemantics       = flag.String("sentry.up-semantics", exporter.UpFullyFunctional, fmt.Sprintf("what sentry_up reports; %s is 0 on any failure, %s stays 1 if sentry rejects the auth token.  sentry_auth_ok reports the token either way", exporter.UpFullyFunctional, exporter.UpReachability))
+	maxProjects       = flag.Int("sentry.max-projects", 0, "most projects to fetch stats for per scrape; past it further projects are skipped, with a warning.  0 for no limit")
+	requestBudget     = flag.Int("sentry.max-requests-per-scrape", 0, "most requests to send to sentry per scrape; past it the scrape's remaining fetches are skipped and it serves what it collected.  0 for no limit")
+	shardCount        = flag.Int("metrics.shard-count", 0, "add a shard label to project metrics, a stable hash of the project ID modulo this; 0 disables")
+	shard             = flag.Int("metrics.shard", -1, "only collect projects in this shard, in [0, -metrics.shard-count); -1 collects all of them")
+	collectStored     = flag.Bool("sentry.collect-stored", false, "also collect the count of events sentry stored, labeling project stats with a received or stored dimension")
+	statResolution    = flag.String("sentry.stat-resolution", "10s", "stat bucket size to request from sentry; one of 10s, 1h, or 1d")
+	statWindow        = flag.Duration("sentry.stat-window", 15*time.Second, "how far back to request stats; -sentry.aggregate-mode decides what's exported from the window")
+	aggregateMode     = flag.String("sentry.aggregate-mode", exporter.AggregateLast, fmt.Sprintf("how to reduce the stat window to a value; %s exports the newest bucket with its timestamp, %s exports the sum of the window as sentry_project_events_window", exporter.AggregateLast, exporter.AggregateSum))
+	organizations     = flag.String("sentry.organizations", "", "comma separated organization slugs to collect; empty collects every organization the token can see")
+	excludeOrgs       = flag.String("sentry.exclude-organizations", "", "comma separated organization slugs to skip")
+	projects          = flag.String("sentry.projects", "", "comma separated project slug patterns to collect, * matching any run of characters; empty collects every project")
+	excludeProjects   = flag.String("sentry.exclude-projects", "", "comma separated project slug patterns to skip, * matching any run of characters")
+	teamlessProjects  = flag.String("sentry.teamless-projects", exporter.TeamlessProjectsPlaceholder, "how to report projects that no team lists: placeholder (team_slug=\""+exporter.TeamlessPlaceholder+"\"), empty (empty team labels), or drop.  Projects in any team are only reported under their teams")
+	orgConcurrency    = flag.Int("sentry.org-concurrency", 1, "level of concurrent organization detail requests to allow against the given sentry; independent of -sentry.fetch-concurrency")
+	statConcurrency   = flag.Int("sentry.stat-concurrency", 1, "level of concurrent stats requests to allow per project, taken from idle -sentry.fetch-concurrency workers; the total stays within -sentry.fetch-concurrency")
+	pageSize          = flag.Int("sentry.page-size", 0, "page size to request when paginating organizations and projects, up to 100.  0 uses sentry's default")
 	logLevel          = flag.String("log.level", "info", "log level")
+	logFormat         = flag.String("log.format", "text", "log output format; text or json")
+	configURL         = flag.String("config.url", "", "http url serving a YAML config in the -config.file format, fetched at startup and merged over -config.file.  Its organization and project filters are refetched every -config.url-refresh-interval")
+	configRefresh     = flag.Duration("config.url-refresh-interval", 5*time.Minute, "how often to refetch -config.url for its filters.  0 only fetches it at startup")
+	showVersion       = flag.Bool("version", false, "print version information and exit")
 )
 
-func integrateEnvAndCheckFlag(flagName string, envName string, flagValue *string) error {
-	if *flagValue == "" {
-		s := os.Getenv(envName)
-		if s != "" {
-			*flagValue = s
+// stringsFlag is a flag that may be repeated, collecting each value given
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+var (
+	sentryURLs       stringsFlag
+	sentryAuthTokens stringsFlag
+	configFiles      stringsFlag
+)
+
+func init() {
+	flag.Var(&sentryURLs, "sentry.url", "http `url` for the sentry instance to talk to; repeat for several instances, labeling their metrics with an instance label.  Cal be specified via environment variable SENTRY_URL")
+	flag.Var(&configFiles, "config.file", "YAML `file` of instances, filters, stat types, resolution, and concurrency settings; see the README.  Repeat to merge several in order, later files overriding earlier ones.  Flags given on the command line take precedence")
+	flag.Var(&sentryAuthTokens, "sentry.auth-token", "bearer `token` to use for authorization; repeat to give each -sentry.url its own, in the same order.  Can be specified via environment variable SENTRY_AUTH_TOKEN")
+	deprecateFlag("sentry.concurrency", "sentry.fetch-concurrency")
+}
+
+// namespacePattern is what a metric name prefix has to match
+var namespacePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// envIgnoredFlags aren't settable from the environment; VERSION in particular is
+// commonly set in containers for other reasons.
+var envIgnoredFlags = map[string]bool{
+	"version": true,
+}
+
+// flagEnvName returns the environment variable for the flag, its name upper cased
+// with . and - replaced by _; -web.listen-address is WEB_LISTEN_ADDRESS.
+func flagEnvName(name string) string {
+	return strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// applyEnv set each flag that wasn't given on the command line from its
+// environment variable, if that's set and non empty.  Flags set this way count as
+// given for -config.file.
+func applyEnv() error {
+	given := givenFlags()
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || envIgnoredFlags[f.Name] || err != nil {
+			return
 		}
-	}
-	if *flagValue == "" {
+		// deprecated flags share their replacement's value, and its own variable
+		// wins over theirs.
+		if replacement, deprecated := deprecatedFlags[f.Name]; deprecated && (given[replacement] || os.Getenv(flagEnvName(replacement)) != "") {
+			return
+		}
+		if value := os.Getenv(flagEnvName(f.Name)); value != "" {
+			if setErr := flag.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid environment variable %s for -%s: %s", flagEnvName(f.Name), f.Name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// requireFlag fail if the flag wasn't given on the command line, via envName,
+// or by -config.file
+func requireFlag(flagName string, envName string, flagValue *stringsFlag) error {
+	if len(*flagValue) == 0 {
 		return fmt.Errorf("neither %s nor environment variable %s was defined; this required", flagName, envName)
 	}
 	return nil
 }
 
+// sentryInstance is a sentry server to export, along with its exporter
+type sentryInstance struct {
+	url      string
+	exporter *exporter.Exporter
+}
+
+// registerInstances register the exporter of each instance with reg.  With more
+// than one instance, each one's metrics are labeled with its url.
+func registerInstances(reg prometheus.Registerer, instances []sentryInstance) error {
+	for _, instance := range instances {
+		instanceReg := reg
+		if len(instances) > 1 {
+			instanceReg = prometheus.WrapRegistererWith(prometheus.Labels{"instance": instance.url}, reg)
+		}
+		if err := instanceReg.Register(instance.exporter); err != nil {
+			return fmt.Errorf("failed registering exporter for %s: %s", instance.url, err)
+		}
+	}
+	return nil
+}
+
+// namedConfig is a parsed config along with where it came from, for errors
+type namedConfig struct {
+	name string
+	file *config.File
+}
+
+// loadConfigFiles parse the config files at paths
+func loadConfigFiles(paths []string) ([]namedConfig, error) {
+	var configs []namedConfig
+	for _, path := range paths {
+		file, err := config.LoadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		configs = append(configs, namedConfig{path, file})
+	}
+	return configs, nil
+}
+
+// mergeConfigs returns the settings configs give for each flag, merged in order;
+// a key in a later config replaces that key from earlier ones, lists included,
+// and a later config's instances replace earlier instances, tokens included.
+func mergeConfigs(configs []namedConfig) (map[string][]config.Setting, error) {
+	merged := make(map[string][]config.Setting)
+	for _, named := range configs {
+		settings, err := named.file.Settings()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", named.name, err)
+		}
+		fileSettings := make(map[string][]config.Setting)
+		for _, setting := range settings {
+			setting.Key = fmt.Sprintf("%s: %s", named.name, setting.Key)
+			fileSettings[setting.Flag] = append(fileSettings[setting.Flag], setting)
+		}
+		if _, ok := fileSettings["sentry.url"]; ok {
+			delete(merged, "sentry.auth-token")
+		}
+		for flagName, flagSettings := range fileSettings {
+			merged[flagName] = flagSettings
+		}
+	}
+	return merged, nil
+}
+
+// givenFlags returns the names of the flags set so far; setting a deprecated
+// flag counts as setting its replacement.
+func givenFlags() map[string]bool {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+		if replacement, deprecated := deprecatedFlags[f.Name]; deprecated {
+			given[replacement] = true
+		}
+	})
+	return given
+}
+
+// applySettings set each flag settings, from mergeConfigs, give a value for
+// unless it's in given.  Giving -sentry.url replaces the configs' instances
+// entirely, tokens included.
+func applySettings(settings map[string][]config.Setting, given map[string]bool) error {
+	// set in a stable order, so errors are reported consistently
+	flagNames := make([]string, 0, len(settings))
+	for flagName := range settings {
+		flagNames = append(flagNames, flagName)
+	}
+	sort.Strings(flagNames)
+	for _, flagName := range flagNames {
+		if given[flagName] || (flagName == "sentry.auth-token" && given["sentry.url"]) {
+			continue
+		}
+		for _, setting := range settings[flagName] {
+			if err := flag.Set(setting.Flag, setting.Value); err != nil {
+				return fmt.Errorf("%s: %s", setting.Key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// deprecatedFlags maps flags kept working for compatibility to the flag that
+// replaces them; add entries via deprecateFlag.
+var deprecatedFlags = map[string]string{}
+
+// deprecateFlag define old as an alias for the already defined flag replacement,
+// so renaming a flag doesn't break existing deployments.  Must be called before
+// flag.Parse.
+func deprecateFlag(old, replacement string) {
+	f := flag.Lookup(replacement)
+	if f == nil {
+		panic(fmt.Sprintf("deprecated flag %s replaced by undefined flag %s", old, replacement))
+	}
+	flag.Var(f.Value, old, fmt.Sprintf("deprecated, use -%s", replacement))
+	deprecatedFlags[old] = replacement
+}
+
+// reportDeprecatedFlags warn about each deprecated flag that was set, returning a
+// gauge marking them.
+func reportDeprecatedFlags() *prometheus.GaugeVec {
+	used := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: *namespace,
+		Subsystem: "exporter",
+		Name:      "deprecated_flag_used",
+		Help:      "boolean, 1 for each deprecated flag the exporter was started with",
+	}, []string{"flag"})
+	flag.Visit(func(f *flag.Flag) {
+		if replacement, ok := deprecatedFlags[f.Name]; ok {
+			log.Warnf("-%s is deprecated and will be removed; use -%s instead", f.Name, replacement)
+			used.WithLabelValues(f.Name).Set(1)
+		}
+	})
+	return used
+}
+
+// secretFlags are left out of configHash; the hash is exported, and drift in
+// credentials isn't something to surface in metrics.
+var secretFlags = map[string]bool{
+	"sentry.auth-token": true,
+}
+
+// credentialURLFlags are urls that may carry credentials in their userinfo or
+// query; configHash only covers the rest of them.
+var credentialURLFlags = map[string]bool{
+	"sentry.proxy-url": true,
+	"config.url":       true,
+}
+
+// stripCredentials returns rawURL without its userinfo and query, or nothing if
+// it doesn't parse.
+func stripCredentials(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	parsed.User = nil
+	parsed.RawQuery = ""
+	return parsed.String()
+}
+
+// configHash returns a hash of the effective value of every non secret flag,
+// taking the values in overrides over the flags' own.
+func configHash(overrides map[string]string) uint32 {
+	h := fnv.New32a()
+	flag.VisitAll(func(f *flag.Flag) {
+		// deprecated flags share their replacement's value.
+		if _, deprecated := deprecatedFlags[f.Name]; deprecated || secretFlags[f.Name] {
+			return
+		}
+		value, ok := overrides[f.Name]
+		if !ok {
+			value = f.Value.String()
+		}
+		if credentialURLFlags[f.Name] {
+			value = stripCredentials(value)
+		}
+		fmt.Fprintf(h, "%s=%s\n", f.Name, value)
+	})
+	return h.Sum32()
+}
+
 const metricsIndexPage = `<html>
 	<head><title>prometheus_sentry_exporter</title</head>
 	<body>
@@ -45,36 +368,334 @@ const metricsIndexPage = `<html>
 </html>
 `
 
+// sentryTLSConfig returns the TLS configuration for connecting to sentry, or nil
+// if the defaults suffice.
+func sentryTLSConfig() (*tls.Config, error) {
+	if *tlsServerName == "" && *caFile == "" && !*insecureTLS {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{ServerName: *tlsServerName, InsecureSkipVerify: *insecureTLS}
+	if *caFile != "" {
+		pem, err := ioutil.ReadFile(*caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading -sentry.ca-file: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("-sentry.ca-file %s holds no PEM certificates", *caFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// sentryTransport returns the transport for requests to sentry, applying
+// the -sentry TLS flags and -sentry.proxy-url
+func sentryTransport() (*http.Transport, error) {
+	tlsConfig, err := sentryTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if *proxyURL != "" {
+		proxy, err := url.Parse(*proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -sentry.proxy-url: %s", err)
+		}
+		if (proxy.Scheme != "http" && proxy.Scheme != "https" && proxy.Scheme != "socks5") || proxy.Host == "" {
+			return nil, fmt.Errorf("invalid -sentry.proxy-url %q: must be a http, https, or socks5 url", *proxyURL)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	return transport, nil
+}
+
+// normalizeSentryURL returns rawURL without trailing slashes, failing unless it's
+// an http or https url with a host
+func normalizeSentryURL(rawURL string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid url %q: %s", rawURL, err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", fmt.Errorf("must be an http or https url such as https://sentry.example.com, got %q", rawURL)
+	}
+	parsed.Path = strings.TrimRight(parsed.Path, "/")
+	parsed.RawPath = ""
+	return parsed.String(), nil
+}
+
+// newSentryClient returns a client for the sentry at sentryURL, authenticating
+// with token and sending requests via transport
+func newSentryClient(sentryURL, token string, transport http.RoundTripper) (*sentry.Client, error) {
+	timeout := int(sentryTimeout.Seconds())
+	apiURL := fmt.Sprintf("%s/api/0/", sentryURL)
+	client, err := sentry.NewClient(token, &apiURL, &timeout)
+	if err != nil {
+		return nil, err
+	}
+	client.HTTPClient.Transport = transport
+	return client, nil
+}
+
 func main() {
 	flag.Parse()
-	if err := integrateEnvAndCheckFlag("-sentry.url", "SENTRY_URL", sentryURL); err != nil {
+	if *showVersion {
+		fmt.Println(version.Print("prometheus_sentry_exporter"))
+		return
+	}
+	if err := applyEnv(); err != nil {
+		log.Fatal(err.Error())
+	}
+	given := givenFlags()
+	configs, err := loadConfigFiles(configFiles)
+	if err != nil {
+		log.Fatalf("invalid -config.file %s", err)
+	}
+	settings, err := mergeConfigs(configs)
+	if err != nil {
+		log.Fatalf("invalid -config.file %s", err)
+	}
+	var refresher *configRefresher
+	if *configURL != "" {
+		if refresher, err = newConfigRefresher(*configURL, settings, given); err != nil {
+			log.Fatalf("invalid -config.url: %s", err)
+		}
+		if settings, err = mergeConfigs(append(configs, refresher.startup)); err != nil {
+			log.Fatalf("invalid -config.url: %s", err)
+		}
+	}
+	if err := applySettings(settings, given); err != nil {
+		log.Fatalf("invalid setting in %s", err)
+	}
+	if err := requireFlag("-sentry.url", "SENTRY_URL", &sentryURLs); err != nil {
 		log.Fatal(err.Error())
 	}
-	if err := integrateEnvAndCheckFlag("-sentry.auth-token", "SENTRY_AUTH_TOKEN", sentryAuthToken); err != nil {
+	if err := requireFlag("-sentry.auth-token", "SENTRY_AUTH_TOKEN", &sentryAuthTokens); err != nil {
 		log.Fatal(err.Error())
 	}
+	for i, sentryURL := range sentryURLs {
+		normalized, err := normalizeSentryURL(sentryURL)
+		if err != nil {
+			log.Fatalf("invalid -sentry.url: %s", err)
+		}
+		sentryURLs[i] = normalized
+	}
+	if len(sentryAuthTokens) != 1 && len(sentryAuthTokens) != len(sentryURLs) {
+		log.Fatalf("got %d -sentry.auth-token for %d -sentry.url; give one shared token or one per url", len(sentryAuthTokens), len(sentryURLs))
+	}
+	if !namespacePattern.MatchString(*namespace) {
+		log.Fatalf("-metrics.namespace must match %s, got %q", namespacePattern, *namespace)
+	}
 	if *sentryConcurrency <= 0 {
-		log.Fatalf("-senrty.concurency needs to be >= 1, got %d", *sentryConcurrency)
+		log.Fatalf("-sentry.fetch-concurrency needs to be >= 1, got %d", *sentryConcurrency)
+	}
+	if *globalConcurrency < 0 {
+		log.Fatalf("-sentry.global-concurrency must be >= 0, got %d", *globalConcurrency)
+	}
+	if *degradedThreshold < 0 || *degradedThreshold > 1 {
+		log.Fatalf("-sentry.degraded-threshold must be between 0 and 1, got %v", *degradedThreshold)
 	}
-	if err := log.Base().SetLevel(*logLevel); err != nil {
+	if err := configureLogging(*logLevel, *logFormat); err != nil {
 		log.Fatal(err.Error())
 	}
 
-	timeout := int(sentryTimeout.Seconds())
-	apiURL := fmt.Sprintf("%s/api/0/", *sentryURL)
-	client, err := sentry.NewClient(*sentryAuthToken, &apiURL, &timeout)
+	savedQueryList, err := config.ParseList(*savedQueries)
+	if err != nil {
+		log.Fatalf("invalid -sentry.saved-queries: %s", err)
+	}
+	organizationList, err := config.ParseList(*organizations)
+	if err != nil {
+		log.Fatalf("invalid -sentry.organizations: %s", err)
+	}
+	excludeOrgList, err := config.ParseList(*excludeOrgs)
 	if err != nil {
-		log.Fatalf("failed to create sentry client: %s", err)
+		log.Fatalf("invalid -sentry.exclude-organizations: %s", err)
 	}
-	metricExporter, err := exporter.NewExporter(client, uint32(*sentryConcurrency), "sentry")
+	projectList, err := config.ParseGlobs(*projects)
 	if err != nil {
-		log.Fatalf("failed to create exporter: %s", err)
+		log.Fatalf("invalid -sentry.projects: %s", err)
 	}
-	prometheus.MustRegister(metricExporter)
+	excludeProjectList, err := config.ParseGlobs(*excludeProjects)
+	if err != nil {
+		log.Fatalf("invalid -sentry.exclude-projects: %s", err)
+	}
+	statTypeList, err := config.ParseChoices(*statTypes, exporter.StatTypes())
+	if err != nil {
+		log.Fatalf("invalid -sentry.stat-types: %s", err)
+	}
+	if len(statTypeList) == 0 {
+		log.Fatal("-sentry.stat-types must list at least one stat type")
+	}
+	transport, err := sentryTransport()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	useTLS, err := checkWebTLS()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	// handlers are added to the default mux further down.
+	handler, err := webHandler(http.DefaultServeMux)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	options := []exporter.Option{
+		exporter.WithStatResolution(*statResolution, *statWindow),
+		exporter.WithMaxLabelLength(*maxLabelLength),
+		exporter.WithTeamlessProjects(*teamlessProjects),
+		exporter.WithRetryQueuePasses(*retryQueuePasses),
+		exporter.WithRetries(*retryMax, *retryBaseDelay),
+		exporter.WithRetryBackoff(*retryMaxDelay, *retryJitter),
+		exporter.WithOwnership(*collectOwnership),
+		exporter.WithMinScrapeInterval(*minScrapeInterval),
+		exporter.WithScrapeTimeout(*scrapeTimeout),
+		exporter.WithTopologyCache(*topologyCacheTTL),
+		exporter.WithKeyStats(*collectKeys, *maxKeysPerProject),
+		exporter.WithAlignedBuckets(*alignBuckets),
+		exporter.WithOrgConcurrency(*orgConcurrency),
+		exporter.WithStatConcurrency(*statConcurrency),
+		exporter.WithPageSize(*pageSize),
+		exporter.WithSourceLabel(*sourceLabel),
+		exporter.WithTimeouts(*enumTimeout, *statsTimeout),
+		exporter.WithGroupByTag(*groupByTag),
+		exporter.WithRatios(*emitRatios),
+		exporter.WithStatBuckets(*emitStatBuckets),
+		exporter.WithSavedQueries(savedQueryList),
+		exporter.WithRateLimit(*rps),
+		exporter.WithStatTypes(statTypeList),
+		exporter.WithDistribution(*emitDistribution),
+		exporter.WithProjectSeries(*projectSeries),
+		exporter.WithProjectState(*projectState),
+		exporter.WithIssueCounts(*collectIssues),
+		exporter.WithRateLimits(*collectRateLimits),
+		exporter.WithReleases(*collectReleases, *maxReleases),
+		exporter.WithMembership(*collectMembership),
+		exporter.WithSplitByType(*splitByType),
+		exporter.WithUpSemantics(*upSemantics),
+		exporter.WithRequestBudget(*requestBudget),
+		exporter.WithMaxProjects(*maxProjects),
+		exporter.WithSharding(*shardCount, *shard),
+		exporter.WithStoredStats(*collectStored),
+		exporter.WithAggregateMode(*aggregateMode),
+		exporter.WithOrganizationFilter(organizationList, excludeOrgList),
+		exporter.WithProjectFilter(projectList, excludeProjectList),
+	}
+	if *globalConcurrency > 0 {
+		options = append(options, exporter.WithSharedConcurrency(exporter.NewSharedConcurrency(*globalConcurrency)))
+	}
+	var backfillDay time.Time
+	if *backfillDate != "" {
+		if backfillDay, err = time.Parse("2006-01-02", *backfillDate); err != nil {
+			log.Fatalf("invalid -sentry.backfill-date: %s", err)
+		}
+		options = append(options, exporter.WithBackfillDay(backfillDay))
+	}
+	// each instance gets its own client and exporter, so concurrency and rate
+	// limits apply per instance, save for -sentry.global-concurrency.
+	var instances []sentryInstance
+	for i, sentryURL := range sentryURLs {
+		token := sentryAuthTokens[0]
+		if len(sentryAuthTokens) > 1 {
+			token = sentryAuthTokens[i]
+		}
+		client, err := newSentryClient(sentryURL, token, transport)
+		if err != nil {
+			log.Fatalf("failed to create sentry client for %s: %s", sentryURL, err)
+		}
+		metricExporter, err := exporter.NewExporter(
+			client,
+			uint32(*sentryConcurrency),
+			*namespace,
+			options...,
+		)
+		if err != nil {
+			log.Fatalf("failed to create exporter for %s: %s", sentryURL, err)
+		}
+		instances = append(instances, sentryInstance{url: sentryURL, exporter: metricExporter})
+	}
+	if *dryRunMode {
+		if err := dryRun(instances); err != nil {
+			log.Fatalf("dry run failed: %s", err)
+		}
+		return
+	}
+	if *backfillDate != "" {
+		if err := backfill(instances, *backfillOutput); err != nil {
+			log.Fatalf("backfill of %s failed: %s", *backfillDate, err)
+		}
+		return
+	}
+	// the go and process collectors are what the default registry would have.
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	if err := registerInstances(registry, instances); err != nil {
+		log.Fatal(err.Error())
+	}
+	configHashGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *namespace,
+		Subsystem: "exporter",
+		Name:      "config_hash",
+		Help:      "hash of the exporter's effective configuration, excluding secrets",
+	})
+	configHashGauge.Set(float64(configHash(nil)))
+	registry.MustRegister(configHashGauge)
+	registry.MustRegister(reportDeprecatedFlags())
+	registry.MustRegister(version.NewCollector(*namespace + "_exporter"))
+	if refresher != nil {
+		refresher.register(registry, configHashGauge)
+		if *configRefresh > 0 {
+			go refresher.run(instances, *configRefresh)
+		}
+	}
+	log.Infof("starting prometheus_sentry_exporter %s", version.Info())
 	log.Infof("starting server; telemetry accessible at %s%s", *listen, *metricsPath)
-	http.Handle(*metricsPath, prometheus.Handler())
+	metricsHandler := promhttp.InstrumentMetricHandler(registry, promhttp.HandlerFor(registry, promhttp.HandlerOpts{ErrorLog: log.StandardLogger()}))
+	http.Handle(*metricsPath, legacyHandlerMetrics(registry, metricsHandler))
+	http.HandleFunc("/healthz", healthHandler)
+	http.Handle("/ready", readyHandler(instances, *degradedThreshold))
+	if *enableProbe {
+		extraTargets, err := config.ParseList(*probeTargets)
+		if err != nil {
+			log.Fatalf("invalid -web.probe-targets: %s", err)
+		}
+		targets, err := probeTargetTokens(sentryURLs, sentryAuthTokens, extraTargets)
+		if err != nil {
+			log.Fatalf("invalid -web.probe-targets: %s", err)
+		}
+		var cache *probeCache
+		if *probeCacheTTL > 0 {
+			cache = newProbeCache(*probeCacheTTL)
+			registry.MustRegister(cache.hits, cache.misses)
+		}
+		http.Handle("/probe", probeHandler(targets, transport, options, organizationFilter(organizationList, excludeOrgList), cache))
+	}
 	http.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
 		io.WriteString(w, metricsIndexPage)
 	})
-	log.Fatal(http.ListenAndServe(*listen, nil))
+	server := &http.Server{Addr: *listen, Handler: handler}
+	// closed once Shutdown returns; ListenAndServe returns as soon as it's called.
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		log.Infof("received %s, shutting down", <-signals)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownGrace)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Warnf("in flight requests didn't finish within %s: %s", *shutdownGrace, err)
+		}
+	}()
+	if useTLS {
+		err = server.ListenAndServeTLS(*tlsCertFile, *tlsKeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err.Error())
+	}
+	<-shutdown
+	log.Info("shutdown complete")
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ferringb/prometheus_sentry_exporter/exporter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// organizationFilter returns if an organization slug passes the include list, if
+// it's non empty, and the exclude list
+func organizationFilter(include, exclude []string) func(slug string) bool {
+	return func(slug string) bool {
+		for _, excluded := range exclude {
+			if slug == excluded {
+				return false
+			}
+		}
+		if len(include) == 0 {
+			return true
+		}
+		for _, included := range include {
+			if slug == included {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// probeKey identifies probes that collect the same thing
+type probeKey struct {
+	target, org string
+}
+
+// probeEntry is the gathered result of a probe; ready is closed once it's in,
+// and expires is zero until then.
+type probeEntry struct {
+	ready    chan struct{}
+	families []*dto.MetricFamily
+	err      error
+	expires  time.Time
+}
+
+// probeCache holds the results of recent probes for ttl, so a burst of identical
+// probes, say from several Prometheus replicas, costs sentry a single collection.
+// Probes arriving while an identical one is collecting wait for its result.
+type probeCache struct {
+	ttl          time.Duration
+	hits, misses *prometheus.CounterVec
+	lock         sync.Mutex
+	entries      map[probeKey]*probeEntry
+}
+
+func newProbeCache(ttl time.Duration) *probeCache {
+	return &probeCache{
+		ttl: ttl,
+		hits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: *namespace,
+			Subsystem: "exporter",
+			Name:      "cache_hits_total",
+			Help:      "requests served from the cached result of an identical earlier request",
+		}, []string{"endpoint"}),
+		misses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: *namespace,
+			Subsystem: "exporter",
+			Name:      "cache_misses_total",
+			Help:      "requests that had no cached result to serve, and collected from sentry",
+		}, []string{"endpoint"}),
+		entries: make(map[probeKey]*probeEntry),
+	}
+}
+
+// gather returns the cached result for key, calling gather for it if there's
+// none.  Failed results aren't cached.
+func (c *probeCache) gather(key probeKey, gather func() ([]*dto.MetricFamily, error)) ([]*dto.MetricFamily, error) {
+	c.lock.Lock()
+	now := time.Now()
+	if entry, ok := c.entries[key]; ok && (entry.expires.IsZero() || now.Before(entry.expires)) {
+		c.lock.Unlock()
+		c.hits.WithLabelValues("/probe").Inc()
+		<-entry.ready
+		return entry.families, entry.err
+	}
+	for cachedKey, entry := range c.entries {
+		if !entry.expires.IsZero() && !now.Before(entry.expires) {
+			delete(c.entries, cachedKey)
+		}
+	}
+	entry := &probeEntry{ready: make(chan struct{})}
+	c.entries[key] = entry
+	c.lock.Unlock()
+	c.misses.WithLabelValues("/probe").Inc()
+
+	families, err := gather()
+	c.lock.Lock()
+	entry.families, entry.err = families, err
+	if err != nil {
+		delete(c.entries, key)
+	} else {
+		entry.expires = time.Now().Add(c.ttl)
+	}
+	c.lock.Unlock()
+	close(entry.ready)
+	return families, err
+}
+
+// probeTargetTokens returns the targets /probe may collect, normalized, mapped to
+// the token to authenticate to each with: every sentry url gets its own token, or
+// the shared one if there's just one, and the extra targets the first token.
+func probeTargetTokens(sentryURLs, tokens, extra []string) (map[string]string, error) {
+	targets := make(map[string]string)
+	for i, sentryURL := range sentryURLs {
+		token := tokens[0]
+		if len(tokens) > 1 {
+			token = tokens[i]
+		}
+		targets[sentryURL] = token
+	}
+	for _, target := range extra {
+		normalized, err := normalizeSentryURL(target)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := targets[normalized]; !ok {
+			targets[normalized] = tokens[0]
+		}
+	}
+	return targets, nil
+}
+
+// probeHandler serves a collection of the sentry named by the target query
+// parameter, in the style of blackbox_exporter.  Only the targets in targets may
+// be probed, authenticating with the token they map to; anything else gets a 403
+// rather than being sent a token.  An org parameter restricts the probe to that
+// organization, which must pass orgWanted; the configured organization filters
+// still apply to probes.  Each probe gets its own client and exporter, sharing
+// transport's connections; if cache isn't nil, identical probes within its ttl
+// are served the first one's result.
+func probeHandler(targets map[string]string, transport http.RoundTripper, options []exporter.Option, orgWanted func(slug string) bool, cache *probeCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		target, err := normalizeSentryURL(query.Get("target"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid target parameter: %s", err), http.StatusBadRequest)
+			return
+		}
+		token, ok := targets[target]
+		if !ok {
+			http.Error(w, fmt.Sprintf("target %q isn't one of -sentry.url or -web.probe-targets", target), http.StatusForbidden)
+			return
+		}
+		probeOptions := options[:len(options):len(options)]
+		org := query.Get("org")
+		if org != "" {
+			if !orgWanted(org) {
+				http.Error(w, fmt.Sprintf("organization %q is excluded by the exporter's organization filters", org), http.StatusForbidden)
+				return
+			}
+			probeOptions = append(probeOptions, exporter.WithOrganizationFilter([]string{org}, nil))
+		}
+		client, err := newSentryClient(target, token, transport)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to create sentry client: %s", err), http.StatusInternalServerError)
+			return
+		}
+		probeExporter, err := exporter.NewExporter(client, uint32(*sentryConcurrency), *namespace, probeOptions...)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to create exporter: %s", err), http.StatusInternalServerError)
+			return
+		}
+		log.Debugf("probing %s", target)
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(probeExporter)
+		var gatherer prometheus.Gatherer = registry
+		if cache != nil {
+			gatherer = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+				return cache.gather(probeKey{target, org}, registry.Gather)
+			})
+		}
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
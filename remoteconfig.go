@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/ferringb/prometheus_sentry_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// configFetchTimeout bounds each fetch of -config.url
+const configFetchTimeout = 30 * time.Second
+
+// configFilterFlags are the flags a -config.url refresh applies to the running
+// exporters; everything else it gives only takes effect at startup.
+var configFilterFlags = []string{
+	"sentry.organizations",
+	"sentry.exclude-organizations",
+	"sentry.projects",
+	"sentry.exclude-projects",
+}
+
+// fetchConfig fetch and parse the YAML config served at configURL
+func fetchConfig(configURL string) (*config.File, error) {
+	client := &http.Client{Timeout: configFetchTimeout}
+	resp, err := client.Get(configURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status %s", resp.Status)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return config.Parse(content)
+}
+
+// configRefresher refetch the config at -config.url, swapping the organization
+// and project filters it gives into the exporters of the -sentry.url instances.
+type configRefresher struct {
+	url string
+	// the config as fetched at startup, and the settings of the last fetch
+	// that applied
+	startup  namedConfig
+	settings map[string][]config.Setting
+	// filter values for when the url stops giving them; flags given on the
+	// command line or environment are never overridden
+	base  map[string]string
+	given map[string]bool
+	// the filter values the last refresh applied, and the config_hash gauge
+	// they're folded into, if registered
+	applied map[string]string
+	hash    prometheus.Gauge
+	// 1 if the last fetch succeeded, and the unix time of the last that did;
+	// atomic
+	lastOK, lastSuccess int64
+}
+
+// newConfigRefresher fetch the config at configURL, merged over the config file
+// settings given.
+func newConfigRefresher(configURL string, fileSettings map[string][]config.Setting, given map[string]bool) (*configRefresher, error) {
+	file, err := fetchConfig(configURL)
+	if err != nil {
+		return nil, err
+	}
+	r := &configRefresher{
+		url:         configURL,
+		startup:     namedConfig{configURL, file},
+		base:        make(map[string]string),
+		given:       given,
+		lastOK:      1,
+		lastSuccess: time.Now().Unix(),
+	}
+	if r.settings, err = mergeConfigs([]namedConfig{r.startup}); err != nil {
+		return nil, err
+	}
+	for _, name := range configFilterFlags {
+		r.base[name] = flag.Lookup(name).DefValue
+		if settings := fileSettings[name]; len(settings) != 0 {
+			r.base[name] = settings[0].Value
+		}
+	}
+	return r, nil
+}
+
+// register the refresher's metrics with reg; hash is the config_hash gauge,
+// recomputed whenever a refresh changes the filters.
+func (r *configRefresher) register(reg prometheus.Registerer, hash prometheus.Gauge) {
+	r.hash = hash
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: *namespace,
+		Subsystem: "exporter",
+		Name:      "config_last_fetch_success",
+		Help:      "boolean, 1 if the last fetch of -config.url succeeded",
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&r.lastOK))
+	}))
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: *namespace,
+		Subsystem: "exporter",
+		Name:      "config_last_fetch_success_timestamp_seconds",
+		Help:      "unix time of the last successful fetch of -config.url",
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&r.lastSuccess))
+	}))
+}
+
+// refresh refetch the config, setting the filters it results in on every
+// instance's exporter.  A config that fails to fetch or validate changes nothing.
+func (r *configRefresher) refresh(instances []sentryInstance) error {
+	file, err := fetchConfig(r.url)
+	if err != nil {
+		return err
+	}
+	settings, err := mergeConfigs([]namedConfig{{r.url, file}})
+	if err != nil {
+		return err
+	}
+	for name, flagSettings := range settings {
+		if !contains(configFilterFlags, name) && !reflect.DeepEqual(flagSettings, r.settings[name]) {
+			log.Warnf("-config.url changed %s; only its filters are refreshed, restart to apply the rest", name)
+		}
+	}
+	values := make(map[string]string)
+	for _, name := range configFilterFlags {
+		switch {
+		case r.given[name]:
+			values[name] = flag.Lookup(name).Value.String()
+		case len(settings[name]) != 0:
+			values[name] = settings[name][0].Value
+		default:
+			values[name] = r.base[name]
+		}
+	}
+	parsed := make(map[string][]string)
+	for name, parse := range map[string]func(string) ([]string, error){
+		"sentry.organizations":         config.ParseList,
+		"sentry.exclude-organizations": config.ParseList,
+		"sentry.projects":              config.ParseGlobs,
+		"sentry.exclude-projects":      config.ParseGlobs,
+	} {
+		if parsed[name], err = parse(values[name]); err != nil {
+			return fmt.Errorf("invalid %s: %s", name, err)
+		}
+	}
+	for _, instance := range instances {
+		err := instance.exporter.SetFilters(parsed["sentry.organizations"], parsed["sentry.exclude-organizations"], parsed["sentry.projects"], parsed["sentry.exclude-projects"])
+		if err != nil {
+			return fmt.Errorf("failed setting the filters of %s: %s", instance.url, err)
+		}
+	}
+	r.settings = settings
+	if r.hash != nil && !reflect.DeepEqual(values, r.applied) {
+		r.hash.Set(float64(configHash(values)))
+	}
+	r.applied = values
+	return nil
+}
+
+// run refresh every interval, forever
+func (r *configRefresher) run(instances []sentryInstance, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := r.refresh(instances); err != nil {
+			log.WithField("url", r.url).WithField("error", err).Warn("failed refreshing -config.url")
+			atomic.StoreInt64(&r.lastOK, 0)
+			continue
+		}
+		log.WithField("url", r.url).Debug("refreshed -config.url")
+		atomic.StoreInt64(&r.lastOK, 1)
+		atomic.StoreInt64(&r.lastSuccess, time.Now().Unix())
+	}
+}
+
+// contains returns if value is one of values
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// basicAuth wraps handler, answering requests lacking the configured
+// credentials with a 401.
+type basicAuth struct {
+	user, password string
+	handler        http.Handler
+}
+
+// unauthenticatedPaths are served without credentials, so orchestrators can
+// probe them; they reveal nothing about sentry.
+var unauthenticatedPaths = map[string]bool{"/healthz": true, "/ready": true}
+
+func (a *basicAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if unauthenticatedPaths[r.URL.Path] {
+		a.handler.ServeHTTP(w, r)
+		return
+	}
+	user, password, ok := r.BasicAuth()
+	// compare both regardless so the response time doesn't say which was wrong.
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) == 1
+	if !ok || !userOK || !passwordOK {
+		w.Header().Set("WWW-Authenticate", `Basic realm="prometheus_sentry_exporter"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	a.handler.ServeHTTP(w, r)
+}
+
+// webHandler returns handler wrapped in basic auth if it's configured, failing
+// if it's only partially configured or the password file is unreadable.
+func webHandler(handler http.Handler) (http.Handler, error) {
+	if *authUser == "" && *authPasswordFile == "" {
+		return handler, nil
+	}
+	if *authUser == "" || *authPasswordFile == "" {
+		return nil, fmt.Errorf("-web.basic-auth-user and -web.basic-auth-password-file must be given together")
+	}
+	password, err := ioutil.ReadFile(*authPasswordFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading -web.basic-auth-password-file: %s", err)
+	}
+	trimmed := strings.TrimRight(string(password), "\r\n")
+	if trimmed == "" {
+		return nil, fmt.Errorf("-web.basic-auth-password-file %s is empty", *authPasswordFile)
+	}
+	return &basicAuth{user: *authUser, password: trimmed, handler: handler}, nil
+}
+
+// legacyHandlerMetrics wraps handler with the http_* metrics prometheus.Handler()
+// exported about /metrics, registering them with reg, so dashboards and alerts
+// built on them keep working alongside the promhttp_metric_handler_* ones.
+func legacyHandlerMetrics(reg prometheus.Registerer, handler http.Handler) http.Handler {
+	labels := prometheus.Labels{"handler": "prometheus"}
+	summaryOpts := func(name, help string) prometheus.SummaryOpts {
+		return prometheus.SummaryOpts{
+			Subsystem:   "http",
+			Name:        name,
+			Help:        help,
+			ConstLabels: labels,
+			Objectives:  map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		}
+	}
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem:   "http",
+		Name:        "requests_total",
+		Help:        "Total number of HTTP requests made.",
+		ConstLabels: labels,
+	}, []string{"code", "method"})
+	duration := prometheus.NewSummary(summaryOpts("request_duration_microseconds", "The HTTP request latencies in microseconds."))
+	requestSize := prometheus.NewSummaryVec(summaryOpts("request_size_bytes", "The HTTP request sizes in bytes."), nil)
+	responseSize := prometheus.NewSummaryVec(summaryOpts("response_size_bytes", "The HTTP response sizes in bytes."), nil)
+	reg.MustRegister(requests, duration, requestSize, responseSize)
+	instrumented := promhttp.InstrumentHandlerCounter(requests,
+		promhttp.InstrumentHandlerRequestSize(requestSize,
+			promhttp.InstrumentHandlerResponseSize(responseSize, handler)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		instrumented.ServeHTTP(w, r)
+		duration.Observe(float64(time.Since(start)) / float64(time.Microsecond))
+	})
+}
+
+// healthHandler answers liveness probes; serving at all means the process is up.
+func healthHandler(w http.ResponseWriter, _ *http.Request) {
+	io.WriteString(w, "ok\n")
+}
+
+// readyHandler answers readiness probes, succeeding once every instance's
+// exporter has reached sentry.  Instances whose last scrape fetched less than
+// degradedThreshold of their project stats are reported as degraded, which still
+// succeeds.  It never queries sentry itself.
+func readyHandler(instances []sentryInstance, degradedThreshold float64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		var degraded []string
+		for _, instance := range instances {
+			if !instance.exporter.Ready() {
+				http.Error(w, fmt.Sprintf("%s hasn't been reached yet", instance.url), http.StatusServiceUnavailable)
+				return
+			}
+			if ratio := instance.exporter.SuccessRatio(); ratio < degradedThreshold {
+				degraded = append(degraded, fmt.Sprintf("degraded: %s fetched %.0f%% of project stats in its last scrape\n", instance.url, ratio*100))
+			}
+		}
+		if len(degraded) != 0 {
+			io.WriteString(w, strings.Join(degraded, ""))
+			return
+		}
+		io.WriteString(w, "ok\n")
+	})
+}
+
+// checkWebTLS returns if the server should use TLS, failing if it's only
+// partially configured or the certificate and key don't load.
+func checkWebTLS() (bool, error) {
+	if *tlsCertFile == "" && *tlsKeyFile == "" {
+		return false, nil
+	}
+	if *tlsCertFile == "" || *tlsKeyFile == "" {
+		return false, fmt.Errorf("-web.tls-cert-file and -web.tls-key-file must be given together")
+	}
+	if _, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile); err != nil {
+		return false, fmt.Errorf("failed loading the web TLS certificate: %s", err)
+	}
+	return true, nil
+}